@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/ocf"
+)
+
+// loadAvroSchema read and parse an avro record schema from an AvroSchemaFile
+func loadAvroSchema(path string) (*avro.RecordSchema, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := avro.Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := schema.(*avro.RecordSchema)
+	if !ok {
+		return nil, fmt.Errorf("schema in %s is a %s, it must be a record", path, schema.Type())
+	}
+	return rec, nil
+}
+
+// avroEncoderConfig per-output settings for Format avro; makes one avroObjectEncoder per object
+type avroEncoderConfig struct {
+	// schema from AvroSchemaFile; when nil, a schema is inferred from the records in each object
+	schema *avro.RecordSchema
+
+	// avro block codec
+	compression CompressionType
+
+	// maximum number of records in each avro block
+	blockLength int
+
+	// names of the timestamp and tag fields, which every inferred schema has
+	timeKey string
+	tagKey  string
+}
+
+func (cfg *avroEncoderConfig) NewObjectEncoder() IObjectEncoder {
+	return &avroObjectEncoder{config: cfg}
+}
+
+func (cfg *avroEncoderConfig) FileExtension() string {
+	return ".avro"
+}
+
+// codec the avro block codec matching our Compression option
+func (cfg *avroEncoderConfig) codec() ocf.CodecName {
+	switch cfg.compression {
+	case CompressionGzip:
+		return ocf.Deflate
+	case CompressionZstd:
+		return ocf.ZStandard
+	case CompressionSnappy:
+		return ocf.Snappy
+	default:
+		return ocf.Null
+	}
+}
+
+// avroObjectEncoder collects the records of one object and writes them out as an avro object container file on commit
+type avroObjectEncoder struct {
+	config  *avroEncoderConfig
+	records []bufferedRecord
+	size    int64
+}
+
+func (enc *avroObjectEncoder) AddRecord(tag string, timestamp float64, fields logFields) error {
+	enc.records = append(enc.records, bufferedRecord{tag: tag, timestamp: timestamp, fields: fields})
+	enc.size += bufferedRecordSize(tag, fields)
+	return nil
+}
+
+func (enc *avroObjectEncoder) Size() int64 {
+	return enc.size
+}
+
+// WriteTo write all the collected records as an avro object container file to w
+//
+// A record that doesn't fit the schema is logged and left out, rather than
+// failing the whole object.
+func (enc *avroObjectEncoder) WriteTo(w io.Writer) (int64, error) {
+	schema := enc.config.schema
+	if schema == nil {
+		var err error
+		if schema, err = inferAvroSchema(enc.records, enc.config.timeKey, enc.config.tagKey); err != nil {
+			return 0, err
+		}
+	}
+
+	cw := &countingWriter{w: w}
+	ow, err := ocf.NewEncoderWithSchema(schema, cw,
+		ocf.WithCodec(enc.config.codec()),
+		ocf.WithBlockLength(enc.config.blockLength),
+	)
+	if err != nil {
+		return cw.n, err
+	}
+
+	timeKey, tagKey := avroName(enc.config.timeKey), avroName(enc.config.tagKey)
+	for _, rec := range enc.records {
+		named := make(map[string]interface{}, len(rec.fields)+2)
+		for key, val := range rec.fields {
+			named[avroName(key)] = val
+		}
+		named[timeKey] = time.UnixMicro(int64(math.Round(rec.timestamp * 1e6)))
+		named[tagKey] = rec.tag
+
+		row := make(map[string]interface{}, len(schema.Fields()))
+		for _, field := range schema.Fields() {
+			if val, ok := named[field.Name()]; ok {
+				row[field.Name()] = avroValue(field.Type(), val)
+			} else if field.HasDefault() {
+				row[field.Name()] = field.Default()
+			}
+		}
+
+		// marshal each record on its own first, so a bad one can't corrupt the block
+		datum, err := avro.Marshal(schema, row)
+		if err != nil {
+			logger.Warn().Str("tag", rec.tag).Err(err).Msg("record does not fit the avro schema, dropping it")
+			continue
+		}
+		if _, err := ow.Write(datum); err != nil {
+			return cw.n, err
+		}
+	}
+
+	enc.records = nil
+	enc.size = 0
+
+	err = ow.Close()
+	return cw.n, err
+}
+
+// avroName make a valid avro name out of a record key, by replacing invalid characters with _
+func avroName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// inferAvroSchema build an avro record schema from the columns inferred across the records of an object
+func inferAvroSchema(records []bufferedRecord, timeKey, tagKey string) (*avro.RecordSchema, error) {
+	fields := []map[string]interface{}{
+		{"name": avroName(timeKey), "type": map[string]string{"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": avroName(tagKey), "type": "string"},
+	}
+	seen := map[string]bool{avroName(timeKey): true, avroName(tagKey): true}
+	for _, col := range inferColumns(records, timeKey, tagKey) {
+		name := avroName(col.name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		typ := map[columnType]string{
+			columnString:  "string",
+			columnInt64:   "long",
+			columnDouble:  "double",
+			columnBoolean: "boolean",
+		}[col.typ]
+		fields = append(fields, map[string]interface{}{"name": name, "type": []string{"null", typ}, "default": nil})
+	}
+
+	spec, err := json.Marshal(map[string]interface{}{"type": "record", "name": "log", "fields": fields})
+	if err != nil {
+		return nil, err
+	}
+	schema, err := avro.Parse(string(spec))
+	if err != nil {
+		return nil, err
+	}
+	return schema.(*avro.RecordSchema), nil
+}
+
+// avroValue convert a decoded record value to the go type avro expects for a field's schema.
+// Values of other (complex) types are passed through as they are.
+func avroValue(schema avro.Schema, val interface{}) interface{} {
+	if val == nil {
+		return nil
+	}
+	switch s := schema.(type) {
+	case *avro.UnionSchema:
+		// nullable unions of one other type, like ["null", "string"]
+		if nullable, typ := s.Indices(); nullable >= 0 && len(s.Types()) == 2 {
+			return avroValue(s.Types()[typ], val)
+		}
+	case *avro.PrimitiveSchema:
+		if ls := s.Logical(); ls != nil {
+			switch ls.Type() {
+			case avro.TimestampMicros, avro.TimestampMillis:
+				if t, ok := val.(time.Time); ok {
+					return t
+				}
+			}
+		}
+		// the record timestamp, in a field that isn't a logical timestamp
+		if t, ok := val.(time.Time); ok {
+			switch s.Type() {
+			case avro.Long:
+				return t.UnixMicro()
+			case avro.String:
+				return t.UTC().Format(time.RFC3339Nano)
+			}
+			val = float64(t.UnixMicro()) / 1e6
+		}
+		switch s.Type() {
+		case avro.String:
+			return columnValue(columnString, val)
+		case avro.Long:
+			return columnValue(columnInt64, val)
+		case avro.Int:
+			if v, ok := columnValue(columnInt64, val).(int64); ok {
+				return int(v)
+			}
+		case avro.Double:
+			return columnValue(columnDouble, val)
+		case avro.Float:
+			if v, ok := columnValue(columnDouble, val).(float64); ok {
+				return float32(v)
+			}
+		case avro.Boolean:
+			return columnValue(columnBoolean, val)
+		}
+		return nil
+	}
+	return val
+}
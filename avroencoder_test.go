@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/v2/ocf"
+)
+
+// readAvroForTest read every record of an avro object container file held in memory
+func readAvroForTest(t *testing.T, b []byte) (*ocf.Decoder, []map[string]any) {
+	t.Helper()
+	dec, err := ocf.NewDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("not a valid avro file: %s", err)
+	}
+	var rows []map[string]any
+	for dec.HasNext() {
+		row := map[string]any{}
+		if err := dec.Decode(&row); err != nil {
+			t.Fatalf("could not decode record: %s", err)
+		}
+		rows = append(rows, row)
+	}
+	return dec, rows
+}
+
+// Test_avroName do we make valid avro names out of any record key?
+func Test_avroName(t *testing.T) {
+	for key, want := range map[string]string{
+		"Mem.total": "Mem_total",
+		"@t":        "_t",
+		"9lives":    "_9lives",
+		"ok_2":      "ok_2",
+		"":          "_",
+	} {
+		if got := avroName(key); got != want {
+			t.Errorf("avroName(%s) wanted: `%s` got: `%s`", key, want, got)
+		}
+	}
+}
+
+// Test_avroObjectEncoder do we write a readable avro file with an inferred or declared schema?
+func Test_avroObjectEncoder(t *testing.T) {
+	when := time.Date(2022, 2, 17, 0, 16, 0, 500000000, time.UTC)
+	ts := float64(when.UnixMicro()) / 1e6
+
+	schemaFile := filepath.Join(t.TempDir(), "schema.avsc")
+	os.WriteFile(schemaFile, []byte(`{"type": "record", "name": "mine", "fields": [
+		{"name": "ts", "type": "double"},
+		{"name": "msg", "type": "string"},
+		{"name": "n", "type": ["null", "int"], "default": null},
+		{"name": "env", "type": "string", "default": "prod"}
+	]}`), 0o644)
+	declared, err := loadAvroSchema(schemaFile)
+	if err != nil {
+		t.Fatalf("loadAvroSchema() returned %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		schema    bool
+		codec     CompressionType
+		wantCodec string
+		want      []map[string]any
+	}{
+		{name: "inferred",
+			codec:     CompressionGzip,
+			wantCodec: "deflate",
+			want: []map[string]any{
+				{"timestamp": when.Local(), "tag": "cpu", "msg": "hello", "Mem_total": int64(3), "n": int64(3)},
+				{"timestamp": when.Local(), "tag": "cpu", "msg": nil, "Mem_total": int64(4), "n": nil},
+			}},
+		{name: "declared; the record without msg is dropped",
+			schema:    true,
+			codec:     CompressionSnappy,
+			wantCodec: "snappy",
+			want: []map[string]any{
+				{"ts": ts, "msg": "hello", "n": 3, "env": "prod"},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &avroEncoderConfig{compression: tt.codec, blockLength: 1, timeKey: "timestamp", tagKey: "tag"}
+			if tt.schema {
+				cfg.schema = declared
+				cfg.timeKey = "ts"
+			}
+			enc := cfg.NewObjectEncoder()
+			enc.AddRecord("cpu", ts, logFields{"msg": "hello", "Mem.total": int64(3), "n": int64(3)})
+			enc.AddRecord("cpu", ts, logFields{"Mem.total": uint16(4)})
+
+			buf := new(bytes.Buffer)
+			written, err := enc.WriteTo(buf)
+			if err != nil {
+				t.Fatalf("WriteTo() returned %s", err)
+			}
+			if written != int64(buf.Len()) {
+				t.Errorf("WriteTo() reported %d bytes but wrote %d", written, buf.Len())
+			}
+
+			dec, rows := readAvroForTest(t, buf.Bytes())
+			if codec := string(dec.Metadata()["avro.codec"]); codec != tt.wantCodec {
+				t.Errorf("wanted codec %s, got %s", tt.wantCodec, codec)
+			}
+			for _, row := range rows {
+				if t, ok := row["timestamp"].(time.Time); ok {
+					row["timestamp"] = t.Local()
+				}
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("wanted: %#v got: %#v", tt.want, rows)
+			}
+		})
+	}
+}
+
+// Test_loadAvroSchema do we refuse schemas that can't describe a log record?
+func Test_loadAvroSchema(t *testing.T) {
+	dir := t.TempDir()
+	notRecord := filepath.Join(dir, "string.avsc")
+	os.WriteFile(notRecord, []byte(`"string"`), 0o644)
+
+	for _, path := range []string{notRecord, filepath.Join(dir, "missing.avsc")} {
+		if _, err := loadAvroSchema(path); err == nil {
+			t.Errorf("loadAvroSchema(%s) should have failed", path)
+		}
+	}
+}
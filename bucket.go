@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// bucketRecheckSeconds how long a bucket that failed its check is left alone before it's checked again
+const bucketRecheckSeconds = 60
+
+// errBucketName a BucketTemplate that rendered as something that can't be a bucket
+var errBucketName = errors.New("BucketTemplate rendered an empty bucket name, or one with a slash")
+
+// bucketNameData template input data for BucketTemplate: that of ObjectNameTemplate, at the time of the flush
+// (but without a .Uuid), and the fields of the record as .Record.<key>
+type bucketNameData struct {
+	objectNameData
+	Record logFields
+}
+
+// bucketCheck when a bucket was checked, and the result
+type bucketCheck struct {
+	err error
+	at  time.Time
+}
+
+// parseBucketTemplate parse a BucketTemplate; a key the record (or partition) doesn't have is an error, rather
+// than a bucket named "<no value>"
+func parseBucketTemplate(text string) (*template.Template, error) {
+	return template.New("bucket").Option("missingkey=error").Parse(text)
+}
+
+// recordBucket the bucket a record goes to: bucketTemplate rendered for the record, or else bucket
+//
+// A rendered bucket is checked the first time it's used. A record whose bucket
+// can't be rendered, or failed its check, goes to bucket when it is set (and is
+// logged and counted, since it isn't where it belongs), and otherwise can't be
+// written.
+func (state *outputState) recordBucket(ctx context.Context, tag string, partition map[string]string, fields logFields) (string, error) {
+	if state.bucketTemplate == nil {
+		return state.bucket, nil
+	}
+	bucket, err := state.renderBucket(tag, partition, fields)
+	if err == nil {
+		err = state.checkedBucket(ctx, bucket)
+	}
+	if err == nil {
+		return bucket, nil
+	}
+	if state.bucket != "" {
+		metrics.bucketFallbacks.WithLabelValues(state.outputID, tag).Inc()
+		logger.Warn().Str("outputID", state.outputID).Str("tag", tag).Str("bucket", state.bucket).Err(err).Msg("record's own bucket can't be used; it goes to Bucket")
+		return state.bucket, nil
+	}
+	return "", err
+}
+
+// renderBucket apply bucketTemplate to a record
+func (state *outputState) renderBucket(tag string, partition map[string]string, fields logFields) (string, error) {
+	now := state.now()
+	if state.rotateTimeZone != nil {
+		now = now.In(state.rotateTimeZone)
+	}
+	data := bucketNameData{objectNameData: newObjectNameData(tag, now, partition), Record: fields}
+	buf := new(strings.Builder)
+	if err := state.bucketTemplate.Execute(buf, data); err != nil {
+		return "", err
+	}
+	bucket := strings.TrimSpace(buf.String())
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) {
+		return "", fmt.Errorf("%w: '%s'", errBucketName, bucket)
+	}
+	return bucket, nil
+}
+
+// checkedBucket check a bucket the first time it's used, and again every bucketRecheckSeconds while it fails
+func (state *outputState) checkedBucket(ctx context.Context, bucket string) error {
+	now := state.now()
+	state.mutex.Lock()
+	chk, checked := state.buckets[bucket]
+	state.mutex.Unlock()
+	if checked && (chk.err == nil || now.Sub(chk.at) < bucketRecheckSeconds*time.Second) {
+		return chk.err
+	}
+
+	// another thread may be checking the same bucket; the checks are cheap enough to let it
+	err := checkBucket(ctx, state.gcsClient, bucket)
+	if err != nil {
+		logger.Error().Str("outputID", state.outputID).Str("bucket", bucket).Err(err).Msg("bucket check failed")
+	} else {
+		logger.Info().Str("outputID", state.outputID).Str("bucket", bucket).Msg("writing to bucket")
+	}
+
+	state.mutex.Lock()
+	if state.buckets == nil {
+		state.buckets = map[string]bucketCheck{}
+	}
+	state.buckets[bucket] = bucketCheck{err: err, at: now}
+	state.mutex.Unlock()
+	return err
+}
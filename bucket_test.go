@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Test_renderBucket is BucketTemplate rendered with the tag, time, partition and record, and does a bucket that
+// can't be rendered fail?
+func Test_renderBucket(t *testing.T) {
+	state := &outputState{clock: newClockForTest(), rotateTimeZone: time.UTC}
+	fields := logFields{"tenant": "acme", "path": "a/b"}
+	partition := map[string]string{"env": "prod"}
+
+	tests := []struct {
+		template string
+		want     string
+		err      bool
+	}{
+		{"logs-{{ .Record.tenant }}", "logs-acme", false},
+		{"{{ .InputTag }}-{{ .Partition.env }}-{{ .Yyyy }}{{ .Mm }}", "my-tag-prod-202403", false},
+		{"logs-{{ .Record.team }}", "", true},
+		{"logs-{{ .Record.path }}", "", true},
+		{"{{ if false }}x{{ end }}", "", true},
+	}
+	for _, tt := range tests {
+		tpl, err := parseBucketTemplate(tt.template)
+		if err != nil {
+			t.Fatalf("parseBucketTemplate(%s) %s", tt.template, err)
+		}
+		state.bucketTemplate = tpl
+		got, err := state.renderBucket("my-tag", partition, fields)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("%s rendered '%s' (%v), wanted '%s'", tt.template, got, err, tt.want)
+		}
+	}
+}
+
+// Test_recordBucket is a bucket checked only the first time it's used, and again after bucketRecheckSeconds while
+// it fails, and does a record go to Bucket when its own bucket failed?
+func Test_recordBucket(t *testing.T) {
+	cli := &storageClientForTest{missing: map[string]bool{"logs-gone": true}}
+	clk := newClockForTest()
+	tpl, _ := parseBucketTemplate("logs-{{ .Record.tenant }}")
+	state := &outputState{outputID: "bucket-fallback", bucketTemplate: tpl, clock: clk, gcsClient: cli}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if bucket, err := state.recordBucket(ctx, "my-tag", nil, logFields{"tenant": "acme"}); bucket != "logs-acme" || err != nil {
+			t.Errorf("bucket '%s' (%v), wanted logs-acme", bucket, err)
+		}
+		if _, err := state.recordBucket(ctx, "my-tag", nil, logFields{"tenant": "gone"}); err == nil {
+			t.Error("a missing bucket without Bucket is not an error")
+		}
+	}
+	if cli.checks["logs-acme"] != 1 || cli.checks["logs-gone"] != 1 {
+		t.Errorf("buckets checked %v, wanted once each", cli.checks)
+	}
+
+	clk.Advance(bucketRecheckSeconds * time.Second)
+	state.bucket = "fallback"
+	if bucket, err := state.recordBucket(ctx, "my-tag", nil, logFields{"tenant": "gone"}); bucket != "fallback" || err != nil {
+		t.Errorf("bucket '%s' (%v), wanted Bucket", bucket, err)
+	}
+	if bucket, _ := state.recordBucket(ctx, "my-tag", nil, logFields{}); bucket != "fallback" {
+		t.Errorf("a record without a tenant went to '%s', wanted Bucket", bucket)
+	}
+	if fallbacks := testutil.ToFloat64(metrics.bucketFallbacks.WithLabelValues("bucket-fallback", "my-tag")); fallbacks != 2 {
+		t.Errorf("%v records counted as gone to Bucket, wanted 2", fallbacks)
+	}
+	if cli.checks["logs-gone"] != 2 {
+		t.Errorf("the missing bucket was checked %d times, wanted again after bucketRecheckSeconds", cli.checks["logs-gone"])
+	}
+}
+
+// Test_flbPluginFlushCtxGo_bucketTemplate do the records of a flush go to a worker per bucket?
+func Test_flbPluginFlushCtxGo_bucketTemplate(t *testing.T) {
+	cli := &storageClientForTest{}
+	tpl, _ := parseBucketTemplate(`used-{{ index .Record "Mem.used" }}`)
+	state := &outputState{
+		bucketTemplate:       tpl,
+		bufferSizeKiB:        19,
+		bufferTimeoutSeconds: 300,
+		compression:          CompressionNone,
+		encoder:              NewRecordEncoder(FormatJSONLines, "ts", "tag"),
+		format:               FormatJSONLines,
+		gcsClient:            cli,
+		outputID:             "1",
+		objectNameTemplate:   "{{ .InputTag }}/x",
+		workers:              map[string]*ObjectWorker{},
+	}
+
+	cbytePtr := goBytesToCBytes(memRecordForTest)
+	flbPluginFlushCtxGo(state, cbytePtr, len(memRecordForTest), "my-tag")
+
+	if len(state.workers) != 2 {
+		t.Fatalf("wanted 2 workers, one per bucket, got %d", len(state.workers))
+	}
+	for _, work := range state.workers {
+		work.Close()
+	}
+	for _, used := range []string{"5124272", "5124296"} {
+		path := "used-" + used + "/my-tag/x"
+		wri, ok := cli.objects[path]
+		if !ok {
+			t.Errorf("no object %s in %v", path, cli.objects)
+			continue
+		}
+		if lines := strings.Count(wri.buf.String(), "\n"); lines != 1 || !strings.Contains(wri.buf.String(), `"Mem.used":`+used) {
+			t.Errorf("%s has the wrong records: %s", path, wri.buf.String())
+		}
+	}
+	rc := NewRetryClient(cli, noWaitRetryPolicy(0), 0, "")
+	if err := checkBucket(context.Background(), rc, "x"); err != nil || cli.checks["x"] != 1 {
+		t.Errorf("the retry client did not check the bucket with its client: %v", cli.checks)
+	}
+}
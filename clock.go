@@ -0,0 +1,28 @@
+package main
+
+import "time"
+
+// clock the time, and the timers, of an ObjectWorker; tests use a clock that only moves when they say so
+type clock interface {
+	Now() time.Time
+
+	// AfterFunc call f in its own goroutine after d
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer a timer started by a clock
+type clockTimer interface {
+	// Stop keep the timer from firing; false when it already fired or was stopped
+	Stop() bool
+}
+
+// realClock the clock on the wall, and the timers of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,78 @@
+// flb-output-gcs-decrypt restores objects written with `Encrypt on`
+//
+// Usage:
+//
+//	flb-output-gcs-decrypt -key kek.key [-o plain.gz] [object.gz.enc]
+//
+// The object is read from stdin when no file is given, and the plaintext (still
+// compressed, if the object was) goes to stdout unless -o is given. A partial
+// output file is removed when the object can't be decrypted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aerospike-managed-cloud-services/flb-output-gcs/envelope"
+)
+
+func main() {
+	name := filepath.Base(os.Args[0])
+	keyFile := flag.String("key", "", "path of the key-encryption key (32 bytes, or base64), as given to EncryptKeyFile")
+	outFile := flag.String("o", "", "path to write the plaintext to (default stdout)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -key FILE [-o FILE] [OBJECT]\n", name)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *keyFile == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := decrypt(*keyFile, flag.Arg(0), *outFile); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// decrypt the object at inPath (or stdin) to outPath (or stdout)
+func decrypt(keyFile, inPath, outPath string) error {
+	kek, err := envelope.ReadKeyFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if inPath != "" {
+		if in, err = os.Open(inPath); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	plain, err := envelope.NewReader(in, kek)
+	if err != nil {
+		return err
+	}
+
+	if outPath == "" {
+		_, err = io.Copy(os.Stdout, plain)
+		return err
+	}
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, plain); err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(outPath)
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// nopWriteCloser an io.WriteCloser for CompressionNone, where Close has nothing to flush
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// flusher a compressor (or encrypter) that can write out the data it holds back without ending its stream
+type flusher interface {
+	Flush() error
+}
+
+// newCompressor wrap w in a writer for the compression type; Close must be called to flush the stream.
+//
+// level 0 means the library's default level. Otherwise levels are 1-9 for gzip
+// and lz4, and 1-22 for zstd (rounded to the nearest level the encoder has).
+// snappy has no levels.
+func newCompressor(w io.Writer, compression CompressionType, level int) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+
+	case CompressionZstd:
+		opts := []zstd.EOption{}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+
+	case CompressionSnappy:
+		// the framing format, so streams can be read back with any snappy tool
+		return snappy.NewBufferedWriter(w), nil
+
+	case CompressionLz4:
+		lzw := lz4.NewWriter(w)
+		if level != 0 {
+			if level < 1 || level > 9 {
+				return nil, fmt.Errorf("lz4 compression level %d should be 1-9", level)
+			}
+			if err := lzw.Apply(lz4.CompressionLevelOption(lz4.Level1 << (level - 1))); err != nil {
+				return nil, err
+			}
+		}
+		return lzw, nil
+
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// compressionExtension the suffix added to an object name for the compression type
+func compressionExtension(compression CompressionType) string {
+	switch compression {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	case CompressionSnappy:
+		return ".sz"
+	case CompressionLz4:
+		return ".lz4"
+	default:
+		return ""
+	}
+}
+
+// compressionContentHeaders Content-Encoding and Content-Type for an object compressed with the compression type.
+//
+// gzip and zstd are registered http content codings, so the object keeps its own
+// content type; snappy and lz4 are not, so the object is typed as the compressed
+// stream instead.
+func compressionContentHeaders(compression CompressionType) (contentEncoding, contentType string) {
+	switch compression {
+	case CompressionGzip:
+		return "gzip", ""
+	case CompressionZstd:
+		return "zstd", ""
+	case CompressionSnappy:
+		return "", "application/x-snappy-framed"
+	case CompressionLz4:
+		return "", "application/x-lz4"
+	default:
+		return "", ""
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"testing"
+	"unsafe"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Test_newCompressor does each compression type produce a stream its usual reader can decompress?
+func Test_newCompressor(t *testing.T) {
+	tests := []struct {
+		compression CompressionType
+		level       int
+		reader      func(io.Reader) (io.Reader, error)
+	}{
+		{CompressionNone, 0, func(r io.Reader) (io.Reader, error) { return r, nil }},
+		{CompressionGzip, 9, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{CompressionZstd, 19, func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+		{CompressionSnappy, 0, func(r io.Reader) (io.Reader, error) { return snappy.NewReader(r), nil }},
+		{CompressionLz4, 9, func(r io.Reader) (io.Reader, error) { return lz4.NewReader(r), nil }},
+		{CompressionLz4, 0, func(r io.Reader) (io.Reader, error) { return lz4.NewReader(r), nil }},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.compression), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			zw, err := newCompressor(buf, tt.compression, tt.level)
+			if err != nil {
+				t.Fatalf("newCompressor() returned %s", err)
+			}
+			zw.Write([]byte("abzabzabz"))
+			zw.Close()
+
+			zr, err := tt.reader(buf)
+			if err != nil {
+				t.Fatalf("could not read the stream: %s", err)
+			}
+			if bb, _ := ioutil.ReadAll(zr); string(bb) != "abzabzabz" {
+				t.Errorf("decompressed '%s'", bb)
+			}
+		})
+	}
+
+	if _, err := newCompressor(new(bytes.Buffer), CompressionLz4, 12); err == nil {
+		t.Error("lz4 level 12 should have been refused")
+	}
+}
+
+// Test_Put_zstd do we name, label and compress a zstd object?
+func Test_Put_zstd(t *testing.T) {
+	cli, _ := sapi.NewClient(context.Background(), storageConfig{})
+
+	work1 := newWork1()
+	work1.compression = CompressionZstd
+
+	work1.Put(cli, *bytes.NewBufferString("abz"))
+
+	want := `^sipiyou/\d{4}/\d\d/\d\d/\d+\.zst$`
+	if rx := regexp.MustCompile(want); rx.FindStringIndex(work1.objectPath) == nil {
+		t.Errorf("wanted: `%s` got: `%s`", want, work1.objectPath)
+	}
+
+	wri := work1.Writer.(*storageWriterForTest)
+	work1.Commit()
+	if wri.attrs.ContentEncoding != "zstd" || wri.attrs.ContentType != "" {
+		t.Errorf("wanted Content-Encoding zstd, got '%s' (Content-Type '%s')", wri.attrs.ContentEncoding, wri.attrs.ContentType)
+	}
+
+	zr, _ := zstd.NewReader(wri.buf)
+	if bb, _ := ioutil.ReadAll(zr); string(bb) != "abz" {
+		t.Errorf("Put() failed, buffer written was '%s'", bb)
+	}
+}
+
+// Test_FLBPluginInit_compressionLevel is a level the compression can't use replaced by the default at init, rather
+// than failing every object?
+func Test_FLBPluginInit_compressionLevel(t *testing.T) {
+	tests := []struct {
+		compression string
+		level       string
+		want        int
+	}{
+		{"gzip", "9", 9},
+		{"gzip", "42", 0},
+		{"zstd", "19", 19},
+		{"lz4", "-3", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.compression+tt.level, func(t *testing.T) {
+			storageAPI = &storageAPIForTest{}
+
+			plugin := unsafe.Pointer(&outputPluginForTest{})
+			flbAPI = &flbOutputAPIForTest{config: opcConfig{
+				"Bucket":           "bucketymcbucketface.example.com",
+				"Compression":      tt.compression,
+				"CompressionLevel": tt.level,
+				"OutputID":         "level",
+			}}
+
+			FLBPluginInit(plugin)
+			defer delete(instances, "level")
+
+			state := stateForTest(plugin)
+			if state.compressionLevel != tt.want {
+				t.Errorf("CompressionLevel %d, wanted %d", state.compressionLevel, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CsvExtraKeysPolicy what to do with record keys that aren't in Columns
+type CsvExtraKeysPolicy string
+
+const (
+	CsvExtraKeysIgnore  CsvExtraKeysPolicy = "ignore"
+	CsvExtraKeysReject  CsvExtraKeysPolicy = "reject"
+	CsvExtraKeysCollect CsvExtraKeysPolicy = "collect"
+)
+
+// CsvMissingPolicy what to do with records that don't have a value for every one of Columns
+type CsvMissingPolicy string
+
+const (
+	CsvMissingEmpty  CsvMissingPolicy = "empty"
+	CsvMissingReject CsvMissingPolicy = "reject"
+)
+
+// csvExtraColumn name of the last column, which holds the leftover keys of a record under CsvExtraKeys collect
+const csvExtraColumn = "_extra"
+
+// parseColumnList parse a Columns config value like "time, level, msg"
+func parseColumnList(spec string) []string {
+	var cols []string
+	for _, col := range strings.Split(spec, ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// csvEncoder writes each record as one row of delimited values, in the order given by columns.
+//
+// The timestamp and tag can be selected as columns by their timeKey and tagKey names.
+type csvEncoder struct {
+	columns []string
+	comma   rune
+	extra   CsvExtraKeysPolicy
+	missing CsvMissingPolicy
+	timeKey string
+	tagKey  string
+}
+
+// Header the header row, written once at the start of each object
+func (enc *csvEncoder) Header() []byte {
+	header := enc.columns
+	if enc.extra == CsvExtraKeysCollect {
+		header = append(header[:len(header):len(header)], csvExtraColumn)
+	}
+	buf := new(bytes.Buffer)
+	enc.writeRow(buf, header)
+	return buf.Bytes()
+}
+
+func (enc *csvEncoder) EncodeRecord(buf *bytes.Buffer, tag string, timestamp float64, fields logFields) error {
+	obj := make(logFields, len(fields)+2)
+	for k, v := range fields {
+		obj[k] = v
+	}
+	obj[enc.timeKey] = timestamp
+	obj[enc.tagKey] = tag
+
+	row := make([]string, len(enc.columns), len(enc.columns)+1)
+	for i, col := range enc.columns {
+		val, ok := obj[col]
+		if !ok && enc.missing == CsvMissingReject {
+			return fmt.Errorf("record has no '%s' column", col)
+		}
+		row[i] = csvValue(val)
+		delete(obj, col)
+	}
+	delete(obj, enc.timeKey)
+	delete(obj, enc.tagKey)
+
+	switch enc.extra {
+	case CsvExtraKeysReject:
+		if len(obj) > 0 {
+			keys := make([]string, 0, len(obj))
+			for k := range obj {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return fmt.Errorf("record has keys that aren't in Columns: %s", strings.Join(keys, ", "))
+		}
+	case CsvExtraKeysCollect:
+		extra := ""
+		if len(obj) > 0 {
+			extra = csvValue(map[string]interface{}(obj))
+		}
+		row = append(row, extra)
+	}
+
+	return enc.writeRow(buf, row)
+}
+
+// writeRow write one row, quoting fields as needed
+func (enc *csvEncoder) writeRow(buf *bytes.Buffer, row []string) error {
+	cw := csv.NewWriter(buf)
+	cw.Comma = enc.comma
+	if err := cw.Write(row); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvValue the text of one field; nested values are written as JSON and a missing value as empty
+func csvValue(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(v)
+	default:
+		if marshalled, err := json.Marshal(plainValue(v)); err == nil {
+			return string(marshalled)
+		}
+		return fmt.Sprint(v)
+	}
+}
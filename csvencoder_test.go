@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// Test_csvEncoder do we write quoted rows, in column order, under each extra/missing-key policy?
+func Test_csvEncoder(t *testing.T) {
+	fields := logFields{"msg": "say \"hi\", world", "n": int64(3), "ok": true, "env": "prod"}
+	tests := []struct {
+		name       string
+		encoder    *csvEncoder
+		wantHeader string
+		want       string
+		wantErr    bool
+	}{
+		{name: "csv, ignore extra keys",
+			encoder:    &csvEncoder{columns: []string{"timestamp", "tag", "msg", "n", "missing"}, comma: ',', extra: CsvExtraKeysIgnore, missing: CsvMissingEmpty, timeKey: "timestamp", tagKey: "tag"},
+			wantHeader: "timestamp,tag,msg,n,missing\n",
+			want:       "1644619003.5,cpu,\"say \"\"hi\"\", world\",3,\n"},
+		{name: "tsv, collect extra keys",
+			encoder:    &csvEncoder{columns: []string{"msg", "n"}, comma: '\t', extra: CsvExtraKeysCollect, missing: CsvMissingEmpty, timeKey: "timestamp", tagKey: "tag"},
+			wantHeader: "msg\tn\t_extra\n",
+			want:       "\"say \"\"hi\"\", world\"\t3\t\"{\"\"env\"\":\"\"prod\"\",\"\"ok\"\":true}\"\n"},
+		{name: "reject extra keys",
+			encoder: &csvEncoder{columns: []string{"msg", "n"}, comma: ',', extra: CsvExtraKeysReject, missing: CsvMissingEmpty, timeKey: "timestamp", tagKey: "tag"},
+			wantErr: true},
+		{name: "reject missing columns",
+			encoder: &csvEncoder{columns: []string{"msg", "missing"}, comma: ',', extra: CsvExtraKeysIgnore, missing: CsvMissingReject, timeKey: "timestamp", tagKey: "tag"},
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			err := tt.encoder.EncodeRecord(buf, "cpu", 1644619003.5, fields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EncodeRecord() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("wanted: `%s` got: `%s`", tt.want, got)
+			}
+			if got := string(tt.encoder.Header()); got != tt.wantHeader {
+				t.Errorf("wanted header: `%s` got: `%s`", tt.wantHeader, got)
+			}
+		})
+	}
+}
+
+// Test_Put_header is the header row written once at the start of each object?
+func Test_Put_header(t *testing.T) {
+	cli, _ := sapi.NewClient(context.Background(), storageConfig{})
+
+	work2 := newWork2()
+	work2.bytesMax = 12
+	work2.header = []byte("a,b\n")
+
+	work2.Put(cli, *bytes.NewBufferString("1,2\n"))
+	wri1 := work2.Writer.(*storageWriterForTest)
+	work2.Put(cli, *bytes.NewBufferString("3,4\n"))
+	work2.Put(cli, *bytes.NewBufferString("5,6\n"))
+	wri2 := work2.Writer.(*storageWriterForTest)
+
+	if got := wri1.buf.String(); got != "a,b\n1,2\n3,4\n" {
+		t.Errorf("first object was `%s`", got)
+	}
+	if got := wri2.buf.String(); got != "a,b\n5,6\n" {
+		t.Errorf("second object was `%s`", got)
+	}
+}
@@ -0,0 +1,318 @@
+// Package envelope encrypts a stream with a fresh data key per stream, wrapped by a key-encryption key (KEK).
+//
+// An envelope is laid out as:
+//
+//	magic        "FLBENV1\n"
+//	wrapped key  uint16 length, then nonce || AES-256-GCM(KEK, data key)
+//	base nonce   12 bytes
+//	chunks       uint32 length, then AES-256-GCM(data key, up to ChunkSize bytes)
+//
+// Each chunk's nonce is the base nonce with the chunk number XORed into its
+// last 8 bytes, and its additional data is the chunk number and a flag marking
+// the final chunk, so chunks can't be reordered, dropped or truncated unseen.
+// The final chunk may be empty.
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// Algorithm names the envelope format, e.g. in object metadata
+	Algorithm = "aes-256-gcm-chunked-v1"
+
+	// Extension is added to the name of an encrypted object
+	Extension = ".enc"
+
+	// ChunkSize the most plaintext in one chunk
+	ChunkSize = 64 * 1024
+
+	// KeySize the size of a KEK, and of each data key
+	KeySize = 32
+
+	magic     = "FLBENV1\n"
+	nonceSize = 12
+)
+
+// ErrTruncated the envelope ended before its final chunk
+var ErrTruncated = errors.New("envelope is truncated")
+
+// ErrTrailingData the envelope goes on after its final chunk
+var ErrTrailingData = errors.New("envelope has data after its final chunk")
+
+// ReadKeyFile read an AES-256 key from a file holding either the 32 bytes of the key, or the key in base64
+func ReadKeyFile(path string) ([]byte, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := text
+	if len(text) != KeySize {
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(text)))
+		if err != nil {
+			return nil, fmt.Errorf("key %s is neither %d bytes nor base64: %w", path, KeySize, err)
+		}
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key %s is %d bytes, an AES-256 key is %d", path, len(key), KeySize)
+	}
+	return key, nil
+}
+
+// KeyID a short, non-secret name for a KEK, so an envelope can say which key it needs
+func KeyID(kek []byte) string {
+	sum := sha256.Sum256(kek)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key is %d bytes, an AES-256 key is %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce the nonce of chunk n
+func chunkNonce(base []byte, n uint64) []byte {
+	nonce := bytes.Clone(base)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], n)
+	for i := range counter {
+		nonce[nonceSize-8+i] ^= counter[i]
+	}
+	return nonce
+}
+
+// chunkAD the additional data of chunk n
+func chunkAD(n uint64, final bool) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, n)
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// Writer encrypts everything written to it into an envelope on the underlying writer.
+//
+// Nothing is written to the underlying writer until the first Write or Close.
+// Close writes the final chunk, but doesn't close the underlying writer.
+type Writer struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	header  []byte
+	nonce   []byte
+	chunk   []byte
+	n       uint64
+	started bool
+	closed  bool
+}
+
+// NewWriter constructor; each Writer makes its own data key, wrapped by kek
+func NewWriter(w io.Writer, kek []byte) (*Writer, error) {
+	kekGCM, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, KeySize)
+	wrapNonce := make([]byte, nonceSize)
+	baseNonce := make([]byte, nonceSize)
+	for _, b := range [][]byte{dataKey, wrapNonce, baseNonce} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := kekGCM.Seal(bytes.Clone(wrapNonce), wrapNonce, dataKey, []byte(magic))
+	header := []byte(magic)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	header = append(header, baseNonce...)
+
+	return &Writer{w: w, gcm: gcm, header: header, nonce: baseNonce, chunk: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (ew *Writer) start() error {
+	if ew.started {
+		return nil
+	}
+	ew.started = true
+	_, err := ew.w.Write(ew.header)
+	return err
+}
+
+// seal write the chunk held so far
+func (ew *Writer) seal(final bool) error {
+	sealed := ew.gcm.Seal(nil, chunkNonce(ew.nonce, ew.n), ew.chunk, chunkAD(ew.n, final))
+	ew.n++
+	ew.chunk = ew.chunk[:0]
+	if _, err := ew.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))); err != nil {
+		return err
+	}
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+func (ew *Writer) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errors.New("write to a closed envelope")
+	}
+	if err := ew.start(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data comes, since the final chunk has to be marked
+		if len(ew.chunk) == ChunkSize {
+			if err := ew.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.chunk[len(ew.chunk):ChunkSize], p)
+		ew.chunk = ew.chunk[:len(ew.chunk)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Flush seal the plaintext held so far into a (possibly short) chunk, so that everything written so far reaches the
+// underlying writer
+func (ew *Writer) Flush() error {
+	if ew.closed || len(ew.chunk) == 0 {
+		return nil
+	}
+	return ew.seal(false)
+}
+
+// Close write the final chunk
+func (ew *Writer) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	if err := ew.start(); err != nil {
+		return err
+	}
+	return ew.seal(true)
+}
+
+// reader decrypts an envelope
+type reader struct {
+	r     io.Reader
+	gcm   cipher.AEAD
+	nonce []byte
+	chunk []byte
+	n     uint64
+	final bool
+}
+
+// NewReader read the header of an envelope from r, and unwrap its data key with kek.
+// Reading from the returned reader gives the plaintext, and fails if the envelope was changed or truncated
+func NewReader(r io.Reader, kek []byte) (io.Reader, error) {
+	kekGCM, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, fmt.Errorf("not an envelope: %w", err)
+	}
+	if string(head[:len(magic)]) != magic {
+		return nil, errors.New("not an envelope")
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(head[len(magic):]))
+	baseNonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, ErrTruncated
+	}
+	if _, err := io.ReadFull(r, baseNonce); err != nil {
+		return nil, ErrTruncated
+	}
+	if len(wrapped) < nonceSize {
+		return nil, errors.New("envelope has no data key")
+	}
+	dataKey, err := kekGCM.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], []byte(magic))
+	if err != nil {
+		return nil, errors.New("the data key can't be unwrapped; is this the right key?")
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{r: r, gcm: gcm, nonce: baseNonce}, nil
+}
+
+// open read and decrypt the next chunk; after the final chunk, the envelope must end
+func (er *reader) open() error {
+	var size [4]byte
+	if _, err := io.ReadFull(er.r, size[:]); err != nil {
+		return ErrTruncated
+	}
+	// the length isn't authenticated until the chunk is opened, so it can't be trusted to size the buffer
+	n := binary.BigEndian.Uint32(size[:])
+	if n > uint32(ChunkSize+er.gcm.Overhead()) {
+		return fmt.Errorf("chunk %d of the envelope is %d bytes, more than a chunk holds", er.n, n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(er.r, sealed); err != nil {
+		return ErrTruncated
+	}
+
+	// the final chunk is the one that opens with the final flag
+	nonce := chunkNonce(er.nonce, er.n)
+	chunk, err := er.gcm.Open(nil, nonce, sealed, chunkAD(er.n, false))
+	if err != nil {
+		chunk, err = er.gcm.Open(nil, nonce, sealed, chunkAD(er.n, true))
+		if err != nil {
+			return fmt.Errorf("chunk %d of the envelope can't be decrypted: %w", er.n, err)
+		}
+		er.final = true
+	}
+	er.n++
+	er.chunk = chunk
+
+	if er.final {
+		var extra [1]byte
+		if _, err := io.ReadFull(er.r, extra[:]); err == nil {
+			return ErrTrailingData
+		} else if err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+func (er *reader) Read(p []byte) (int, error) {
+	for len(er.chunk) == 0 {
+		if er.final {
+			return 0, io.EOF
+		}
+		if err := er.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, er.chunk)
+	er.chunk = er.chunk[n:]
+	return n, nil
+}
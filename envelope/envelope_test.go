@@ -0,0 +1,163 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func seal(t *testing.T, kek, plain []byte) []byte {
+	var sealed bytes.Buffer
+	ew, err := NewWriter(&sealed, kek)
+	if err != nil {
+		t.Fatalf("NewWriter() %s", err)
+	}
+	// in pieces that don't line up with the chunks
+	for len(plain) > 0 {
+		n := min(len(plain), 1000)
+		if _, err := ew.Write(plain[:n]); err != nil {
+			t.Fatalf("Write() %s", err)
+		}
+		plain = plain[n:]
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatalf("Close() %s", err)
+	}
+	return sealed.Bytes()
+}
+
+func open(kek, sealed []byte) ([]byte, error) {
+	er, err := NewReader(bytes.NewReader(sealed), kek)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(er)
+}
+
+// Test_roundTrip do we get back what we sealed, whatever its size, and is it sealed with a fresh data key each time?
+func Test_roundTrip(t *testing.T) {
+	kek := bytes.Repeat([]byte{9}, KeySize)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := seal(t, kek, plain)
+		// a few random bytes turn up in any ciphertext by chance
+		if bytes.Contains(sealed, plain) && size >= 16 {
+			t.Errorf("%d bytes: the plaintext is in the envelope", size)
+		}
+		got, err := open(kek, sealed)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: got %d bytes back, %v", size, len(got), err)
+		}
+	}
+
+	if bytes.Equal(seal(t, kek, []byte("same")), seal(t, kek, []byte("same"))) {
+		t.Error("two envelopes of the same plaintext are the same")
+	}
+}
+
+// Test_Flush does everything written before a Flush reach the underlying writer, and read back before the end?
+func Test_Flush(t *testing.T) {
+	kek := bytes.Repeat([]byte{9}, KeySize)
+	var sealed bytes.Buffer
+	ew, _ := NewWriter(&sealed, kek)
+	ew.Write([]byte("first "))
+	if err := ew.Flush(); err != nil {
+		t.Fatalf("Flush() %s", err)
+	}
+	ew.Write(bytes.Repeat([]byte("x"), ChunkSize))
+	ew.Flush()
+	ew.Flush()
+
+	flushed := bytes.Clone(sealed.Bytes())
+	er, _ := NewReader(bytes.NewReader(flushed), kek)
+	got, err := io.ReadAll(er)
+	if len(got) != len("first ")+ChunkSize || err != ErrTruncated {
+		t.Errorf("read %d bytes of the flushed envelope (%v), wanted every byte and then ErrTruncated", len(got), err)
+	}
+
+	ew.Write([]byte(" last"))
+	ew.Close()
+	if got, err := open(kek, sealed.Bytes()); err != nil || !bytes.HasSuffix(got, []byte("x last")) {
+		t.Errorf("got %d bytes back after Close, %v", len(got), err)
+	}
+}
+
+// Test_tampering is a wrong key, a changed byte, a dropped chunk or a truncated envelope refused?
+func Test_tampering(t *testing.T) {
+	kek := bytes.Repeat([]byte{9}, KeySize)
+	plain := bytes.Repeat([]byte("abcdefgh"), ChunkSize/4)
+	sealed := seal(t, kek, plain)
+	headerSize := len(magic) + 2 + nonceSize + KeySize + 16 + nonceSize
+	chunkSize := 4 + ChunkSize + 16
+
+	if _, err := open(bytes.Repeat([]byte{8}, KeySize), sealed); err == nil {
+		t.Error("opened with the wrong key")
+	}
+
+	changed := bytes.Clone(sealed)
+	changed[len(changed)-5] ^= 1
+	if _, err := open(kek, changed); err == nil {
+		t.Error("opened a changed envelope")
+	}
+
+	// without its second (and last) chunk, the first is not marked final
+	if _, err := open(kek, sealed[:headerSize+chunkSize]); err != ErrTruncated {
+		t.Errorf("opening without the final chunk returned %v", err)
+	}
+
+	dropped := append(bytes.Clone(sealed[:headerSize]), sealed[headerSize+chunkSize:]...)
+	if _, err := open(kek, dropped); err == nil {
+		t.Error("opened an envelope with its first chunk dropped")
+	}
+
+	if _, err := open(kek, []byte("plain text")); err == nil {
+		t.Error("opened something that is not an envelope")
+	}
+
+	if _, err := open(kek, append(bytes.Clone(sealed), 0)); err != ErrTrailingData {
+		t.Errorf("opening with data after the final chunk returned %v", err)
+	}
+
+	// a chunk length no writer makes is refused before anything is allocated for it
+	huge := bytes.Clone(sealed)
+	binary.BigEndian.PutUint32(huge[headerSize:], 0xffffffff)
+	if _, err := open(kek, huge); err == nil || err == ErrTruncated {
+		t.Errorf("opening with a chunk of 4 GiB returned %v", err)
+	}
+}
+
+// Test_ReadKeyFile do we take a key as raw bytes or base64, and refuse anything that isn't AES-256?
+func Test_ReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{0xa5}, KeySize)
+	files := map[string][]byte{
+		"raw":    key,
+		"base64": []byte(base64.StdEncoding.EncodeToString(key) + "\n"),
+		"short":  []byte(base64.StdEncoding.EncodeToString(key[:16])),
+		"junk":   []byte("not a key"),
+	}
+	for name, content := range files {
+		os.WriteFile(filepath.Join(dir, name), content, 0o600)
+	}
+
+	for _, name := range []string{"raw", "base64"} {
+		if got, err := ReadKeyFile(filepath.Join(dir, name)); err != nil || !bytes.Equal(got, key) {
+			t.Errorf("%s key: got %v, %v", name, got, err)
+		}
+	}
+	for _, name := range []string{"short", "junk", "missing"} {
+		if _, err := ReadKeyFile(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s key was accepted", name)
+		}
+	}
+
+	if KeyID(key) == KeyID(bytes.Repeat([]byte{1}, KeySize)) || len(KeyID(key)) != 16 {
+		t.Errorf("KeyID() %s", KeyID(key))
+	}
+}
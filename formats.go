@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// FormatType legacy, json_lines, csv, tsv, parquet or avro
+type FormatType string
+
+const (
+	FormatLegacy    FormatType = "legacy"
+	FormatJSONLines FormatType = "json_lines"
+	FormatCSV       FormatType = "csv"
+	FormatTSV       FormatType = "tsv"
+	FormatParquet   FormatType = "parquet"
+	FormatAvro      FormatType = "avro"
+)
+
+// IRecordEncoder serializes one decoded log record into the bytes written to an object
+type IRecordEncoder interface {
+	EncodeRecord(buf *bytes.Buffer, tag string, timestamp float64, fields logFields) error
+}
+
+// IHeaderEncoder a record encoder whose objects each start with a header (e.g. the csv header row)
+type IHeaderEncoder interface {
+	Header() []byte
+}
+
+// IObjectEncoder collects the decoded records of a whole object, for formats
+// (like parquet and avro) that can't be written until every record is known.
+type IObjectEncoder interface {
+	AddRecord(tag string, timestamp float64, fields logFields) error
+
+	// approximate size in bytes of the records collected so far
+	Size() int64
+
+	// write the object's contents to w and forget the collected records
+	WriteTo(w io.Writer) (int64, error)
+}
+
+// IObjectEncoderFactory per-output settings of an object-buffering format; makes one IObjectEncoder per object
+type IObjectEncoderFactory interface {
+	NewObjectEncoder() IObjectEncoder
+
+	// suffix added to each object name, e.g. ".parquet"
+	FileExtension() string
+}
+
+// legacyEncoder writes each record as `<tag>: [ts, {fields}]`, the original layout of this plugin
+type legacyEncoder struct{}
+
+func (enc *legacyEncoder) EncodeRecord(buf *bytes.Buffer, tag string, timestamp float64, fields logFields) error {
+	marshalled, err := json.Marshal(logRec{timestamp, fields})
+	if err != nil {
+		return err
+	}
+	buf.WriteString(fmt.Sprintf("%s: ", tag))
+	buf.Write(marshalled)
+	buf.WriteString("\n")
+	return nil
+}
+
+// jsonLinesEncoder writes each record as one self-contained JSON object per line (NDJSON).
+//
+// The timestamp and tag are added to the object under timeKey and tagKey; a
+// blank key leaves that value out. A record field with the same name as one of
+// these keys is overwritten.
+type jsonLinesEncoder struct {
+	timeKey string
+	tagKey  string
+}
+
+func (enc *jsonLinesEncoder) EncodeRecord(buf *bytes.Buffer, tag string, timestamp float64, fields logFields) error {
+	obj := make(logFields, len(fields)+2)
+	for k, v := range fields {
+		obj[k] = plainValue(v)
+	}
+	if enc.timeKey != "" {
+		obj[enc.timeKey] = timestamp
+	}
+	if enc.tagKey != "" {
+		obj[enc.tagKey] = tag
+	}
+
+	marshalled, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	buf.Write(marshalled)
+	buf.WriteString("\n")
+	return nil
+}
+
+// plainValue a decoded record value with its msgpack strings (which decode as []byte) as strings and its maps keyed
+// by strings, however deeply they're nested, so that it can be written as JSON
+func plainValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []byte:
+		return string(v)
+	case []interface{}:
+		plain := make([]interface{}, len(v))
+		for i, elem := range v {
+			plain[i] = plainValue(elem)
+		}
+		return plain
+	case map[interface{}]interface{}:
+		plain := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			plain[fmt.Sprint(plainValue(key))] = plainValue(elem)
+		}
+		return plain
+	case map[string]interface{}:
+		plain := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			plain[key] = plainValue(elem)
+		}
+		return plain
+	case logFields:
+		return plainValue(map[string]interface{}(v))
+	default:
+		return v
+	}
+}
+
+// NewRecordEncoder constructor; choose the encoder implementation for a format
+func NewRecordEncoder(format FormatType, timeKey, tagKey string) IRecordEncoder {
+	switch format {
+	case FormatJSONLines:
+		return &jsonLinesEncoder{timeKey: timeKey, tagKey: tagKey}
+	default:
+		return &legacyEncoder{}
+	}
+}
+
+// columnType the value types a column may have in a columnar or schema-ful format (parquet, avro)
+type columnType string
+
+const (
+	columnString  columnType = "string"
+	columnInt64   columnType = "int64"
+	columnDouble  columnType = "double"
+	columnBoolean columnType = "boolean"
+)
+
+// recordColumn one column of a declared (or inferred) schema
+type recordColumn struct {
+	name string
+	typ  columnType
+}
+
+// bufferedRecord a record held in memory by an IObjectEncoder until its object is committed
+type bufferedRecord struct {
+	tag       string
+	timestamp float64
+	fields    logFields
+}
+
+// bufferedRecordSize estimate the uncompressed size of a record, so bytesMax still bounds an object that is
+// buffered in memory
+func bufferedRecordSize(tag string, fields logFields) int64 {
+	size := int64(8 + len(tag))
+	for key, val := range fields {
+		size += int64(len(key))
+		if s, ok := val.(string); ok {
+			size += int64(len(s))
+		} else {
+			size += 8
+		}
+	}
+	return size
+}
+
+// inferColumns choose one column type per field name seen across all records of an object.
+//
+// Integer fields become int64 and are widened to double if any record has a
+// fractional value; any other mix of types, and nested values, become string.
+func inferColumns(records []bufferedRecord, timeKey, tagKey string) []recordColumn {
+	types := map[string]columnType{}
+	for _, rec := range records {
+		for key, val := range rec.fields {
+			if val == nil || key == timeKey || key == tagKey {
+				continue
+			}
+			typ := columnTypeOf(val)
+			prev, seen := types[key]
+			switch {
+			case !seen || prev == typ:
+				types[key] = typ
+			case (prev == columnInt64 && typ == columnDouble) || (prev == columnDouble && typ == columnInt64):
+				types[key] = columnDouble
+			default:
+				types[key] = columnString
+			}
+		}
+	}
+
+	columns := make([]recordColumn, 0, len(types))
+	for name, typ := range types {
+		columns = append(columns, recordColumn{name: name, typ: typ})
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+	return columns
+}
+
+// columnTypeOf the narrowest column type that can hold a decoded record value
+func columnTypeOf(val interface{}) columnType {
+	switch val.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return columnInt64
+	case float32, float64:
+		return columnDouble
+	case bool:
+		return columnBoolean
+	default:
+		return columnString
+	}
+}
+
+// columnValue convert a decoded record value to the go type of its column.
+// Values that can't be converted are written as their string representation (or
+// null, for a non-string column).
+func columnValue(typ columnType, val interface{}) interface{} {
+	if val == nil {
+		return nil
+	}
+	switch typ {
+	case columnInt64:
+		switch v := val.(type) {
+		case int:
+			return int64(v)
+		case int8:
+			return int64(v)
+		case int16:
+			return int64(v)
+		case int32:
+			return int64(v)
+		case int64:
+			return v
+		case uint:
+			return int64(v)
+		case uint8:
+			return int64(v)
+		case uint16:
+			return int64(v)
+		case uint32:
+			return int64(v)
+		case uint64:
+			return int64(v)
+		}
+	case columnDouble:
+		switch v := val.(type) {
+		case float32:
+			return float64(v)
+		case float64:
+			return v
+		default:
+			if i, ok := columnValue(columnInt64, val).(int64); ok {
+				return float64(i)
+			}
+		}
+	case columnBoolean:
+		if v, ok := val.(bool); ok {
+			return v
+		}
+	default:
+		switch v := val.(type) {
+		case string:
+			return v
+		case []byte:
+			return string(v)
+		default:
+			if marshalled, err := json.Marshal(plainValue(v)); err == nil {
+				return string(marshalled)
+			}
+			return fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// countingWriter an io.Writer that keeps count of the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Test_EncodeRecord do we serialize a record in each of the supported formats?
+func Test_EncodeRecord(t *testing.T) {
+	fields := logFields{"msg": "hello", "n": 3}
+	tests := []struct {
+		name    string
+		encoder IRecordEncoder
+		want    string
+	}{
+		{name: "legacy",
+			encoder: NewRecordEncoder(FormatLegacy, "timestamp", "tag"),
+			want:    "cpu: [1644619003.5,{\"msg\":\"hello\",\"n\":3}]\n"},
+		{name: "json_lines",
+			encoder: NewRecordEncoder(FormatJSONLines, "timestamp", "tag"),
+			want:    "{\"msg\":\"hello\",\"n\":3,\"tag\":\"cpu\",\"timestamp\":1644619003.5}\n"},
+		{name: "json_lines, custom keys",
+			encoder: NewRecordEncoder(FormatJSONLines, "@t", "msg"),
+			want:    "{\"@t\":1644619003.5,\"msg\":\"cpu\",\"n\":3}\n"},
+		{name: "json_lines, no tag key",
+			encoder: NewRecordEncoder(FormatJSONLines, "time", ""),
+			want:    "{\"msg\":\"hello\",\"n\":3,\"time\":1644619003.5}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := tt.encoder.EncodeRecord(buf, "cpu", 1644619003.5, fields); err != nil {
+				t.Fatalf("EncodeRecord() returned %s", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("wanted: `%s` got: `%s`", tt.want, got)
+			}
+		})
+	}
+}
+
+// Test_plainValue are the strings of a nested record written as strings, in json_lines, csv and string columns?
+func Test_plainValue(t *testing.T) {
+	nested := map[interface{}]interface{}{"pod": []byte("p"), "labels": []interface{}{[]byte("a"), 1}}
+	fields := logFields{"k": nested}
+	want := `{"labels":["a",1],"pod":"p"}`
+
+	buf := new(bytes.Buffer)
+	if err := NewRecordEncoder(FormatJSONLines, "", "").EncodeRecord(buf, "cpu", 1, fields); err != nil || buf.String() != `{"k":`+want+"}\n" {
+		t.Errorf("json_lines wrote `%s` (%v)", buf.String(), err)
+	}
+	if got := csvValue(nested); got != want {
+		t.Errorf("csv wrote `%s`", got)
+	}
+	if got := columnValue(columnString, nested); got != want {
+		t.Errorf("a string column has `%v`", got)
+	}
+
+	// as fluent-bit sends it: [ts, {"k": {"pod": "p"}}]
+	chunk := append(chunkForTest(map[string]string{})[:11], 0x81, 0xa1, 'k', 0x81, 0xa3, 'p', 'o', 'd', 0xa1, 'p')
+	cli := &storageClientForTest{}
+	state := newShutdownStateForTest("nested", cli)
+	state.encoder = NewRecordEncoder(FormatJSONLines, "", "")
+	flbPluginFlushCtxGo(state, goBytesToCBytes(chunk), len(chunk), "my-tag")
+	state.worker("my-tag", nil).Close()
+	for _, wri := range cli.objects {
+		if got := wri.buf.String(); got != `{"k":{"pod":"p"}}`+"\n" {
+			t.Errorf("json_lines wrote `%s` for a decoded record", got)
+		}
+	}
+}
+
+// Test_inferColumns do we pick one type per field across all records of an object?
+func Test_inferColumns(t *testing.T) {
+	records := []bufferedRecord{
+		{fields: logFields{"n": int64(1), "f": uint8(2), "mixed": true, "msg": "a", "tag": "shadowed"}},
+		{fields: logFields{"n": int64(3), "f": 2.5, "mixed": "yes", "nested": map[string]interface{}{"a": 1}, "gone": nil}},
+	}
+	want := []recordColumn{
+		{"f", columnDouble},
+		{"mixed", columnString},
+		{"msg", columnString},
+		{"n", columnInt64},
+		{"nested", columnString},
+	}
+	if got := inferColumns(records, "timestamp", "tag"); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted: %#v got: %#v", want, got)
+	}
+}
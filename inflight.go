@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errInFlightExhausted a flush that found no room in the inFlight budget
+var errInFlightExhausted = errors.New("MaxInFlightBytes are held, waiting for uploads")
+
+// inFlightBudget the bytes held in the process that aren't uploaded yet, across every output instance: the
+// objects being written, and the objects being retried from memory. Flushes wait for room (or are retried by
+// fluent-bit) while the bytes held are over max.
+//
+// The budget is checked before a flush, not reserved by it, so the bytes held can go over max by a flush or so
+type inFlightBudget struct {
+	mutex sync.Mutex
+	held  int64
+
+	// 0 for no limit
+	max int64
+
+	// closed (and replaced) whenever bytes are released, to wake the flushes waiting for room
+	released chan struct{}
+}
+
+func newInFlightBudget() *inFlightBudget {
+	return &inFlightBudget{released: make(chan struct{})}
+}
+
+// inFlight there is one budget per process, whichever output instances set its max
+var inFlight = newInFlightBudget()
+
+// setMax set the limit of the budget, unless another output instance already did, and return the limit
+func (b *inFlightBudget) setMax(max int64) int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.max <= 0 {
+		b.max = max
+	}
+	return b.max
+}
+
+// hold add n bytes to the budget; a negative n releases them
+func (b *inFlightBudget) hold(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.held += n
+	if n < 0 {
+		close(b.released)
+		b.released = make(chan struct{})
+	}
+}
+
+// heldBytes the bytes held
+func (b *inFlightBudget) heldBytes() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.held
+}
+
+// wait for the bytes held to be under max, for up to timeout; false when they're still over it
+func (b *inFlightBudget) wait(timeout time.Duration) bool {
+	var expired <-chan time.Time
+	for {
+		b.mutex.Lock()
+		if b.max <= 0 || b.held < b.max {
+			b.mutex.Unlock()
+			return true
+		}
+		released := b.released
+		b.mutex.Unlock()
+
+		if timeout <= 0 {
+			return false
+		}
+		if expired == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-released:
+		case <-expired:
+			return false
+		}
+	}
+}
+
+// makeInFlightRoom commit the open objects that hold the most bytes, across every output instance (and state, which
+// may not be registered), until the bytes held are under max; false when they're still over it, e.g. because the
+// bytes are held by objects being retried.
+//
+// An open object only releases its bytes when it's committed, so without this a budget filled by open objects would
+// retry every flush until MaxObjectAgeSeconds or IdleTimeoutSeconds commits them, or forever when neither is set.
+func makeInFlightRoom(state *outputState) bool {
+	instancesMutex.Lock()
+	insts := maps.Clone(instances)
+	instancesMutex.Unlock()
+	insts[state.outputID] = state
+
+	type holder struct {
+		outputID string
+		work     *ObjectWorker
+		status   WorkerStatus
+	}
+	var holders []holder
+	for _, inst := range insts {
+		inst.mutex.Lock()
+		if inst.exited {
+			inst.mutex.Unlock()
+			continue
+		}
+		works := make([]*ObjectWorker, 0, len(inst.workers))
+		for _, work := range inst.workers {
+			works = append(works, work)
+		}
+		inst.mutex.Unlock()
+
+		for _, work := range works {
+			if status := work.Status(); status.InFlight > 0 {
+				holders = append(holders, holder{inst.outputID, work, status})
+			}
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].status.InFlight > holders[j].status.InFlight })
+
+	for _, h := range holders {
+		if inFlight.wait(0) {
+			return true
+		}
+		logger.Info().Str("outputID", h.outputID).Str("object", h.status.Object).Int64("held", h.status.InFlight).Msg("committing early to make room under MaxInFlightBytes")
+		if err := h.work.Commit(); err != nil && !errors.Is(err, errWorkerClosed) {
+			logger.Error().Str("outputID", h.outputID).Str("object", h.status.Object).Err(err).Msg("could not commit to make room under MaxInFlightBytes")
+		}
+	}
+	return inFlight.wait(0)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+// Test_inFlightBudget_wait does a wait return once bytes are released, and give up at its timeout?
+func Test_inFlightBudget_wait(t *testing.T) {
+	b := newInFlightBudget()
+	if !b.wait(0) {
+		t.Fatal("a budget without a limit is exhausted")
+	}
+	if limit := b.setMax(100); limit != 100 {
+		t.Fatalf("limit %d, wanted 100", limit)
+	}
+	if limit := b.setMax(200); limit != 100 {
+		t.Errorf("another output changed the limit to %d", limit)
+	}
+
+	b.hold(150)
+	if b.wait(0) {
+		t.Error("150 of 100 bytes held, and there is room")
+	}
+	if b.wait(10 * time.Millisecond) {
+		t.Error("nothing was released, and there is room")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.hold(-20)
+		time.Sleep(10 * time.Millisecond)
+		b.hold(-50)
+	}()
+	if !b.wait(5 * time.Second) {
+		t.Errorf("%d bytes held after the wait", b.heldBytes())
+	}
+	if held := b.heldBytes(); held != 80 {
+		t.Errorf("%d bytes held, wanted 80", held)
+	}
+}
+
+// Test_Put_inFlight does a worker hold the bytes of its object until it is committed?
+func Test_Put_inFlight(t *testing.T) {
+	defer func(saved *inFlightBudget) { inFlight = saved }(inFlight)
+	inFlight = newInFlightBudget()
+
+	cli := &storageClientForTest{}
+	work := NewObjectWorker("my-tag", "bucket", "{{ .InputTag }}", 1024, 0, CompressionNone)
+	defer work.Close()
+	work.Put(cli, *bytes.NewBufferString("0123456789"))
+	if held := inFlight.heldBytes(); held != 10 {
+		t.Errorf("%d bytes held after a put of 10", held)
+	}
+	work.Commit()
+	if held := inFlight.heldBytes(); held != 0 {
+		t.Errorf("%d bytes held after the commit", held)
+	}
+}
+
+// Test_flbPluginFlushCtxGo_maxInFlight does a flush over MaxInFlightBytes commit the open objects to make room,
+// without MaxObjectAgeSeconds or IdleTimeoutSeconds, and is it retried when they don't make room, until bytes are
+// released?
+func Test_flbPluginFlushCtxGo_maxInFlight(t *testing.T) {
+	defer func(saved *inFlightBudget) { inFlight = saved }(inFlight)
+	inFlight = newInFlightBudget()
+	inFlight.setMax(50)
+
+	cli := &storageClientForTest{}
+	state := newShutdownStateForTest("inflight", cli)
+	state.bufferTimeoutSeconds = 0
+	state.idleTimeoutSeconds = 0
+	cbytePtr := goBytesToCBytes(memRecordForTest)
+
+	if rc := flbPluginFlushCtxGo(state, cbytePtr, len(memRecordForTest), "my-tag"); rc != output.FLB_OK {
+		t.Fatalf("the first flush returned %d", rc)
+	}
+	if held := inFlight.heldBytes(); held < 50 {
+		t.Fatalf("%d bytes held, wanted the first flush to fill MaxInFlightBytes", held)
+	}
+	if rc := flbPluginFlushCtxGo(state, cbytePtr, len(memRecordForTest), "other-tag"); rc != output.FLB_OK {
+		t.Errorf("a flush over MaxInFlightBytes returned %d, wanted the open object committed to make room", rc)
+	}
+	if status := state.worker("my-tag", nil).Status(); status.Object != "[closed]" || status.InFlight != 0 {
+		t.Errorf("my-tag's object is still open: %#v", status)
+	}
+
+	// bytes held by objects being retried can't be committed
+	state.worker("other-tag", nil).Commit()
+	inFlight.hold(100)
+	if rc := flbPluginFlushCtxGo(state, cbytePtr, len(memRecordForTest), "my-tag"); rc != output.FLB_RETRY {
+		t.Errorf("a flush with no room to make returned %d", rc)
+	}
+
+	state.inFlightWaitSeconds = 5
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		inFlight.hold(-100)
+	}()
+	if rc := flbPluginFlushCtxGo(state, cbytePtr, len(memRecordForTest), "my-tag"); rc != output.FLB_OK {
+		t.Errorf("a flush that waited for the retries returned %d", rc)
+	}
+	shutdownInstances(map[string]*outputState{"inflight": state})
+}
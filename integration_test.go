@@ -0,0 +1,114 @@
+//go:build integration
+
+// Integration tests against a GCS emulator such as fake-gcs-server, e.g.
+//
+//	docker run -d --rm -p 4443:4443 fsouza/fake-gcs-server -scheme http
+//	GCS_EMULATOR_ENDPOINT=http://localhost:4443/storage/v1/ go test -tags integration -run Integration .
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"regexp"
+	"testing"
+	"unsafe"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// emulatorForTest a client for the emulator (which only has the JSON api), to set up buckets and check on the
+// objects; skips the test when there is no emulator
+func emulatorForTest(t *testing.T) (*storage.Client, string) {
+	endpoint := os.Getenv("GCS_EMULATOR_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("GCS_EMULATOR_ENDPOINT is not set")
+	}
+	cli, err := storage.NewClient(context.Background(), option.WithEndpoint(endpoint), option.WithoutAuthentication(), storage.WithJSONReads())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli, endpoint
+}
+
+// listObjectsForTest read every object in a bucket
+func listObjectsForTest(t *testing.T, cli *storage.Client, bucket string) map[string]string {
+	ctx := context.Background()
+	objects := map[string]string{}
+	it := cli.Bucket(bucket).Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		r, err := cli.Bucket(bucket).Object(attrs.Name).NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects[attrs.Name] = string(content)
+	}
+	return objects
+}
+
+// Test_Integration_flush_commit do records flushed through the plugin land in an object in the emulator's bucket
+// when the plugin exits?
+func Test_Integration_flush_commit(t *testing.T) {
+	cli, endpoint := emulatorForTest(t)
+	ctx := context.Background()
+
+	bucket := "flb-output-gcs-integration"
+	if err := cli.Bucket(bucket).Create(ctx, "test-project", nil); err != nil {
+		t.Logf("Create(%s): %s", bucket, err)
+	}
+	before := listObjectsForTest(t, cli, bucket)
+
+	storageAPI = &storageAPIWrapper{}
+	plugin := unsafe.Pointer(&outputPluginForTest{})
+	flbAPI = &flbOutputAPIForTest{config: opcConfig{
+		"Bucket":             bucket,
+		"Endpoint":           endpoint,
+		"Format":             "json_lines",
+		"NoAuth":             "true",
+		"ObjectNameTemplate": "{{ .InputTag }}/{{ .Uuid }}",
+		"OutputID":           "integration",
+		"ProjectID":          "test-project",
+	}}
+	FLBPluginInit(plugin)
+	defer delete(instances, "integration")
+
+	state := stateForTest(plugin)
+	cbytePtr := goBytesToCBytes(memRecordForTest)
+	if rc := flbPluginFlushCtxGo(state, cbytePtr, len(memRecordForTest), "mem.local"); rc != 1 {
+		t.Fatalf("flush returned %d", rc)
+	}
+
+	// commits the object, and waits for any retries
+	FLBPluginExit()
+
+	after := listObjectsForTest(t, cli, bucket)
+	var created []string
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			created = append(created, name)
+		}
+	}
+	if len(created) != 1 {
+		t.Fatalf("wanted 1 new object, got %v", created)
+	}
+
+	want := `(?m)^\{"Mem.free":\d+,.*"tag":"mem.local","timestamp":\d{10}\.\d{1,6}\}$`
+	if matches := regexp.MustCompile(want).FindAllString(after[created[0]], -1); len(matches) != 2 {
+		t.Errorf("wanted: `%s` (x2) in %s, got: %#v", want, created[0], after[created[0]])
+	}
+}
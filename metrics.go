@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// pluginMetrics the metrics of every output instance in the process, each labeled by output_id and tag
+type pluginMetrics struct {
+	registry *prometheus.Registry
+
+	recordsReceived   *prometheus.CounterVec
+	bytesReceived     *prometheus.CounterVec
+	bytesUncompressed *prometheus.CounterVec
+	bytesCompressed   *prometheus.CounterVec
+	objectsCommitted  *prometheus.CounterVec
+	commitFailures    *prometheus.CounterVec
+	uploadRetries     *prometheus.CounterVec
+	flushRetries      *prometheus.CounterVec
+	openWorkers       *prometheus.GaugeVec
+	workersEvicted    *prometheus.CounterVec
+	bufferedBytes     *prometheus.GaugeVec
+	bucketFallbacks   *prometheus.CounterVec
+}
+
+var metricLabels = []string{"output_id", "tag"}
+
+func newPluginMetrics() *pluginMetrics {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "flb_output_gcs", Name: name, Help: help}, metricLabels)
+	}
+	gauge := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "flb_output_gcs", Name: name, Help: help}, metricLabels)
+	}
+	pm := &pluginMetrics{
+		registry: prometheus.NewRegistry(),
+
+		recordsReceived:   counter("records_received_total", "Records received from fluent-bit."),
+		bytesReceived:     counter("received_bytes_total", "Bytes of msgpack chunks received from fluent-bit."),
+		bytesUncompressed: counter("uncompressed_bytes_total", "Bytes of encoded records written, before compression."),
+		bytesCompressed:   counter("written_bytes_total", "Bytes written to objects, after compression (and encryption)."),
+		objectsCommitted:  counter("objects_committed_total", "Objects committed."),
+		commitFailures:    counter("commit_failures_total", "Objects that could not be committed, and were given up on."),
+		uploadRetries:     counter("upload_retries_total", "Retries of failed object uploads."),
+		flushRetries:      counter("flush_retries_total", "Flushes that returned FLB_RETRY to fluent-bit."),
+		openWorkers:       gauge("open_workers", "Object workers, one per tag and partition."),
+		workersEvicted:    counter("workers_evicted_total", "Object workers closed and forgotten, after being idle or to make room for another."),
+		bufferedBytes:     gauge("buffered_bytes", "Bytes written to objects not yet committed, or held in memory for them."),
+		bucketFallbacks:   counter("bucket_fallbacks_total", "Records written to Bucket because the bucket of their BucketTemplate could not be used."),
+	}
+	pm.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		pm.recordsReceived,
+		pm.bytesReceived,
+		pm.bytesUncompressed,
+		pm.bytesCompressed,
+		pm.objectsCommitted,
+		pm.commitFailures,
+		pm.uploadRetries,
+		pm.flushRetries,
+		pm.openWorkers,
+		pm.workersEvicted,
+		pm.bufferedBytes,
+		pm.bucketFallbacks,
+	)
+	return pm
+}
+
+// metrics there is one set of metrics per process, whichever output instances serve them
+var metrics = newPluginMetrics()
+
+// received count a flush of records from fluent-bit
+func (pm *pluginMetrics) received(outputID, tag string, records int, bytes int) {
+	pm.recordsReceived.WithLabelValues(outputID, tag).Add(float64(records))
+	pm.bytesReceived.WithLabelValues(outputID, tag).Add(float64(bytes))
+}
+
+// workerMetrics the metrics of one worker, already labeled; a nil *workerMetrics counts nothing
+type workerMetrics struct {
+	uncompressed prometheus.Counter
+	compressed   prometheus.Counter
+	committed    prometheus.Counter
+	failures     prometheus.Counter
+	workers      prometheus.Gauge
+	buffered     prometheus.Gauge
+}
+
+// forWorker the metrics of a worker of the output and tag
+func (pm *pluginMetrics) forWorker(outputID, tag string) *workerMetrics {
+	return &workerMetrics{
+		uncompressed: pm.bytesUncompressed.WithLabelValues(outputID, tag),
+		compressed:   pm.bytesCompressed.WithLabelValues(outputID, tag),
+		committed:    pm.objectsCommitted.WithLabelValues(outputID, tag),
+		failures:     pm.commitFailures.WithLabelValues(outputID, tag),
+		workers:      pm.openWorkers.WithLabelValues(outputID, tag),
+		buffered:     pm.bufferedBytes.WithLabelValues(outputID, tag),
+	}
+}
+
+// forgetWorkers delete every series of the output and tag, once none of its workers is left, so that tags that come
+// and go don't add series forever
+func (pm *pluginMetrics) forgetWorkers(outputID, tag string) {
+	for _, vec := range []interface{ DeleteLabelValues(...string) bool }{
+		pm.recordsReceived,
+		pm.bytesReceived,
+		pm.bytesUncompressed,
+		pm.bytesCompressed,
+		pm.objectsCommitted,
+		pm.commitFailures,
+		pm.uploadRetries,
+		pm.flushRetries,
+		pm.openWorkers,
+		pm.workersEvicted,
+		pm.bufferedBytes,
+		pm.bucketFallbacks,
+	} {
+		vec.DeleteLabelValues(outputID, tag)
+	}
+}
+
+func (wm *workerMetrics) opened() {
+	if wm != nil {
+		wm.workers.Inc()
+	}
+}
+
+func (wm *workerMetrics) closed() {
+	if wm != nil {
+		wm.workers.Dec()
+	}
+}
+
+// wrote count bytes written to the object being streamed, before and after compression
+func (wm *workerMetrics) wrote(uncompressed, compressed int64) {
+	if wm != nil {
+		wm.uncompressed.Add(float64(uncompressed))
+		wm.compressed.Add(float64(compressed))
+		wm.buffered.Add(float64(compressed))
+	}
+}
+
+// holding count n more bytes of records held in memory for an object (fewer, when n is negative), before they're
+// written to it
+func (wm *workerMetrics) holding(n int64) {
+	if wm != nil {
+		wm.buffered.Add(float64(n))
+	}
+}
+
+// finished count an object of written bytes that was committed, or failed to be
+func (wm *workerMetrics) finished(written int64, err error) {
+	if wm == nil {
+		return
+	}
+	wm.buffered.Sub(float64(written))
+	if err != nil {
+		wm.failures.Inc()
+	} else {
+		wm.committed.Inc()
+	}
+}
+
+// the one metrics listener of the process, started by the first output instance with a MetricsAddress
+var (
+	metricsMutex    sync.Mutex
+	metricsServer   *http.Server
+	metricsListener net.Listener
+)
+
+// startMetricsServer serve the metrics at http://addr/metrics, unless they're already being served
+func startMetricsServer(addr string) error {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	if metricsServer != nil {
+		if addr != metricsServer.Addr {
+			logger.Warn().Str("MetricsAddress", addr).Str("serving", metricsServer.Addr).Msg("metrics are already served by another output; one listener serves every output")
+		}
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	metricsServer = &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	metricsListener = ln
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Str("MetricsAddress", srv.Addr).Err(err).Msg("metrics listener stopped")
+		}
+	}(metricsServer)
+	logger.Info().Str("MetricsAddress", ln.Addr().String()).Msg("serving metrics at /metrics")
+	return nil
+}
+
+// stopMetricsServer stop the metrics listener, if there is one
+func stopMetricsServer() {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	if metricsServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	metricsServer.Shutdown(ctx)
+	metricsServer, metricsListener = nil, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Test_flbPluginFlushCtxGo_metrics are the records and bytes of a flush, and the objects they go to, counted
+// for the output and tag?
+func Test_flbPluginFlushCtxGo_metrics(t *testing.T) {
+	cli := &storageClientForTest{}
+	state := outputState{
+		bucket:               "bucketymcbucketface.example.com",
+		bufferSizeKiB:        19,
+		bufferTimeoutSeconds: 300,
+		compression:          CompressionGzip,
+		encoder:              NewRecordEncoder(FormatJSONLines, "ts", "tag"),
+		format:               FormatJSONLines,
+		gcsClient:            cli,
+		outputID:             "metrics",
+		objectNameTemplate:   "{{ .InputTag }}/{{ .Uuid }}",
+		tagKey:               "tag",
+		timeKey:              "ts",
+		workers:              map[string]*ObjectWorker{},
+	}
+
+	cbytePtr := goBytesToCBytes(memRecordForTest)
+	flbPluginFlushCtxGo(&state, cbytePtr, len(memRecordForTest), "my-tag")
+
+	if got := testutil.ToFloat64(metrics.openWorkers.WithLabelValues("metrics", "my-tag")); got != 1 {
+		t.Errorf("open_workers %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.bytesUncompressed.WithLabelValues("metrics", "my-tag")); got == 0 {
+		t.Error("no uncompressed bytes counted")
+	}
+
+	for _, work := range state.workers {
+		work.Close()
+	}
+
+	if got := testutil.ToFloat64(metrics.recordsReceived.WithLabelValues("metrics", "my-tag")); got != 2 {
+		t.Errorf("records_received_total %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.bytesReceived.WithLabelValues("metrics", "my-tag")); got != float64(len(memRecordForTest)) {
+		t.Errorf("received_bytes_total %v", got)
+	}
+	written := 0
+	for _, wri := range cli.objects {
+		written += wri.buf.Len()
+	}
+	if got := testutil.ToFloat64(metrics.bytesCompressed.WithLabelValues("metrics", "my-tag")); got != float64(written) {
+		t.Errorf("written_bytes_total %v, but the objects have %d bytes", got, written)
+	}
+	if got := testutil.ToFloat64(metrics.objectsCommitted.WithLabelValues("metrics", "my-tag")); got != 1 {
+		t.Errorf("objects_committed_total %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.bufferedBytes.WithLabelValues("metrics", "my-tag")); got != 0 {
+		t.Errorf("buffered_bytes %v after the object was committed", got)
+	}
+	if got := testutil.ToFloat64(metrics.openWorkers.WithLabelValues("metrics", "my-tag")); got != 0 {
+		t.Errorf("open_workers %v after the workers were closed", got)
+	}
+}
+
+// Test_PutRecord_metrics are the records held for an object counted in buffered_bytes, until it's committed?
+func Test_PutRecord_metrics(t *testing.T) {
+	cli := &storageClientForTest{}
+	work2 := newWork2()
+	work2.clock = newClockForTest()
+	work2.encoderFactory = &objectEncoderForTest{}
+	work2.metrics = metrics.forWorker("metrics-records", "my-tag")
+	buffered := metrics.bufferedBytes.WithLabelValues("metrics-records", "my-tag")
+
+	for i := 0; i < 2; i++ {
+		work2.PutRecord(context.Background(), cli, "my-tag", 1, logFields{})
+	}
+	if got := testutil.ToFloat64(buffered); got != float64(len("my-tag\n")*2) {
+		t.Errorf("buffered_bytes %v while the records are held", got)
+	}
+
+	work2.Commit()
+	if got := testutil.ToFloat64(buffered); got != 0 {
+		t.Errorf("buffered_bytes %v after the object was committed", got)
+	}
+}
+
+// Test_retryClient_metrics are retries, and the objects we gave up on, counted for the output and tag?
+func Test_retryClient_metrics(t *testing.T) {
+	cli := &storageClientForTest{failures: 10}
+	policy := noWaitRetryPolicy(3)
+	policy.outputID = "retries"
+	rc := NewRetryClient(cli, policy, 100, "")
+
+	w := rc.NewWriterFromBucketObjectPath("b", "obj", objectAttrs{Metadata: map[string]string{metadataTag: "my-tag"}}, context.Background())
+	w.Write([]byte("hello"))
+	w.Close()
+	rc.Drain()
+
+	if got := testutil.ToFloat64(metrics.uploadRetries.WithLabelValues("retries", "my-tag")); got != 3 {
+		t.Errorf("upload_retries_total %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.commitFailures.WithLabelValues("retries", "my-tag")); got != 1 {
+		t.Errorf("commit_failures_total %v", got)
+	}
+}
+
+// Test_startMetricsServer are the metrics served at /metrics, by one listener however many outputs ask for one?
+func Test_startMetricsServer(t *testing.T) {
+	if err := startMetricsServer("127.0.0.1:0"); err != nil {
+		t.Fatalf("startMetricsServer() %s", err)
+	}
+	defer stopMetricsServer()
+	addr := metricsListener.Addr().String()
+	if err := startMetricsServer("127.0.0.1:1"); err != nil || metricsListener.Addr().String() != addr {
+		t.Errorf("a second listener was started (%v)", err)
+	}
+
+	metrics.flushRetries.WithLabelValues("served", "my-tag").Inc()
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if want := `flb_output_gcs_flush_retries_total{output_id="served",tag="my-tag"} 1`; !strings.Contains(string(body), want) {
+		t.Errorf("/metrics does not have %s:\n%s", want, body)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// objectAttrs attributes of an object, given to the storage client when the object is created
+type objectAttrs struct {
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	StorageClass    string            `json:"storageClass,omitempty"`
+	CacheControl    string            `json:"cacheControl,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+
+	// name of the customer-managed (KMS) key that encrypts the object
+	KMSKeyName string `json:"kmsKeyName,omitempty"`
+
+	// customer-supplied AES-256 key that encrypts the object. It is never written to a spool or dead-letter sidecar,
+	// only its hash is
+	EncryptionKey []byte `json:"-"`
+}
+
+// metadata keys we add to every object
+const (
+	metadataHost    = "fluentbit-host"
+	metadataTag     = "fluentbit-tag"
+	metadataVersion = "fluentbit-output-gcs-version"
+
+	// with MetadataRecordStats, set when the object is committed
+	metadataFirstRecord = "fluentbit-first-record-time"
+	metadataLastRecord  = "fluentbit-last-record-time"
+	metadataRecords     = "fluentbit-record-count"
+
+	// with Encrypt, what the envelope needs to be opened, and the content headers of what's in it
+	metadataEncryption      = "fluentbit-encryption"
+	metadataEncryptionKeyID = "fluentbit-encryption-key-id"
+	metadataPlainType       = "fluentbit-plaintext-content-type"
+	metadataPlainEncoding   = "fluentbit-plaintext-content-encoding"
+)
+
+// withMetadata a copy of the attributes with more metadata, so the original's map isn't shared
+func (attrs objectAttrs) withMetadata(more map[string]string) objectAttrs {
+	metadata := make(map[string]string, len(attrs.Metadata)+len(more))
+	for k, v := range attrs.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range more {
+		metadata[k] = v
+	}
+	attrs.Metadata = metadata
+	return attrs
+}
+
+// formatContentType the Content-Type of an (uncompressed) object in the format
+func formatContentType(format FormatType) string {
+	switch format {
+	case FormatJSONLines:
+		return "application/x-ndjson"
+	case FormatCSV:
+		return "text/csv"
+	case FormatTSV:
+		return "text/tab-separated-values"
+	case FormatParquet:
+		return "application/vnd.apache.parquet"
+	case FormatAvro:
+		return "application/avro"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// encryptionKeySHA256 the base64 SHA-256 of the customer-supplied key, as storage services take it; "" without a key
+func (attrs objectAttrs) encryptionKeySHA256() string {
+	if attrs.EncryptionKey == nil {
+		return ""
+	}
+	sum := sha256.Sum256(attrs.EncryptionKey)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parseMetadata parse a Metadata config value like "team=infra, env=prod"
+func parseMetadata(spec string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range parseColumnList(spec) {
+		key, val, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("metadata '%s' should be key=value", pair)
+		}
+		metadata[key] = strings.TrimSpace(val)
+	}
+	return metadata, nil
+}
+
+// defaultMetadata the metadata we add to every object of an output
+func defaultMetadata() map[string]string {
+	host, _ := os.Hostname()
+	return map[string]string{
+		metadataHost:    host,
+		metadataVersion: VERSION,
+	}
+}
+
+// recordSpan how many records went into (part of) an object, and the time of the first and last of them
+type recordSpan struct {
+	count       int64
+	first, last float64
+}
+
+// add widen the span to cover another span
+func (span *recordSpan) add(other recordSpan) {
+	if other.count == 0 {
+		return
+	}
+	if span.count == 0 || other.first < span.first {
+		span.first = other.first
+	}
+	if span.count == 0 || other.last > span.last {
+		span.last = other.last
+	}
+	span.count += other.count
+}
+
+// metadata the span as object metadata
+func (span *recordSpan) metadata() map[string]string {
+	metadata := map[string]string{metadataRecords: fmt.Sprint(span.count)}
+	if span.count > 0 {
+		metadata[metadataFirstRecord] = recordTime(span.first)
+		metadata[metadataLastRecord] = recordTime(span.last)
+	}
+	return metadata
+}
+
+// recordTime a record timestamp (in fractional unix seconds) as RFC3339, UTC
+func recordTime(timestamp float64) string {
+	return time.UnixMicro(int64(timestamp * 1e6)).UTC().Format(time.RFC3339Nano)
+}
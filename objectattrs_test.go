@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+// Test_parseMetadata do we parse key=value lists, and refuse pairs without a key?
+func Test_parseMetadata(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{spec: "", want: map[string]string{}},
+		{spec: "team=infra, env = prod", want: map[string]string{"team": "infra", "env": "prod"}},
+		{spec: "empty=", want: map[string]string{"empty": ""}},
+		{spec: "team", wantErr: true},
+		{spec: "=prod", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseMetadata(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_formatContentType does each format get its own Content-Type?
+func Test_formatContentType(t *testing.T) {
+	if got := formatContentType(FormatCSV); got != "text/csv" {
+		t.Errorf("csv got %s", got)
+	}
+	if got := formatContentType(FormatJSONLines); got != "application/x-ndjson" {
+		t.Errorf("json_lines got %s", got)
+	}
+	if got := formatContentType(FormatType("what")); got != "text/plain; charset=utf-8" {
+		t.Errorf("unknown format got %s", got)
+	}
+}
+
+// Test_withMetadata does adding metadata leave the original alone?
+func Test_withMetadata(t *testing.T) {
+	attrs := objectAttrs{ContentType: "text/csv", Metadata: map[string]string{"a": "1"}}
+	more := attrs.withMetadata(map[string]string{"b": "2", "a": "3"})
+	if !reflect.DeepEqual(more.Metadata, map[string]string{"a": "3", "b": "2"}) || more.ContentType != "text/csv" {
+		t.Errorf("withMetadata() = %#v", more)
+	}
+	if !reflect.DeepEqual(attrs.Metadata, map[string]string{"a": "1"}) {
+		t.Errorf("withMetadata() changed the original: %v", attrs.Metadata)
+	}
+}
+
+// Test_recordSpan do spans widen to the earliest and latest record, and count them all?
+func Test_recordSpan(t *testing.T) {
+	span := recordSpan{}
+	if got := span.metadata(); !reflect.DeepEqual(got, map[string]string{metadataRecords: "0"}) {
+		t.Errorf("empty span metadata %v", got)
+	}
+	span.add(recordSpan{count: 2, first: 1700000010, last: 1700000020})
+	span.add(recordSpan{})
+	span.add(recordSpan{count: 1, first: 1700000005.5, last: 1700000005.5})
+	want := map[string]string{
+		metadataRecords:     "3",
+		metadataFirstRecord: "2023-11-14T22:13:25.5Z",
+		metadataLastRecord:  "2023-11-14T22:13:40Z",
+	}
+	if got := span.metadata(); !reflect.DeepEqual(got, want) {
+		t.Errorf("span metadata %v, want %v", got, want)
+	}
+}
+
+// Test_ObjectWorker_attrs does each object get the worker's attributes, its tag, and (with recordStats) the
+// record stats when committed?
+func Test_ObjectWorker_attrs(t *testing.T) {
+	ctx := context.Background()
+	cli, _ := sapi.NewClient(ctx, storageConfig{})
+
+	work1 := newWork1()
+	defer work1.Close()
+	work1.attrs = objectAttrs{ContentType: "text/csv", StorageClass: "NEARLINE", Metadata: map[string]string{"team": "infra"}}
+	work1.recordStats = true
+
+	work1.beginStreaming(context.Background(), cli)
+	wri := work1.Writer.(*storageWriterForTest)
+	if wri.attrs.ContentType != "text/csv" || wri.attrs.ContentEncoding != "gzip" || wri.attrs.StorageClass != "NEARLINE" {
+		t.Errorf("object attrs %#v", wri.attrs)
+	}
+	if wri.attrs.Metadata["team"] != "infra" || wri.attrs.Metadata[metadataTag] != "sipiyou" {
+		t.Errorf("object metadata %v", wri.attrs.Metadata)
+	}
+	if len(work1.attrs.Metadata) != 1 {
+		t.Errorf("the worker's metadata was changed: %v", work1.attrs.Metadata)
+	}
+
+	work1.PutRecords(context.Background(), cli, *bytes.NewBufferString("a\nb\n"), recordSpan{count: 2, first: 1700000000, last: 1700000001})
+	work1.Commit()
+	if wri.commitMetadata[metadataRecords] != "2" || wri.commitMetadata[metadataLastRecord] != "2023-11-14T22:13:21Z" {
+		t.Errorf("commit metadata %v", wri.commitMetadata)
+	}
+}
+
+// Test_encryptionKeySHA256 do we only hash a key that is there?
+func Test_encryptionKeySHA256(t *testing.T) {
+	attrs := objectAttrs{EncryptionKey: bytes.Repeat([]byte{0xa5}, 32)}
+	if attrs.encryptionKeySHA256() == "" || (objectAttrs{}).encryptionKeySHA256() != "" {
+		t.Error("encryptionKeySHA256() should only hash a key that is there")
+	}
+}
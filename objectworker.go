@@ -2,29 +2,154 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"text/template"
 	"time"
 
+	"github.com/aerospike-managed-cloud-services/flb-output-gcs/envelope"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ObjectWorker manages the lifetime of a gcs object
+//
+// All of a worker's state belongs to one goroutine, started by NewObjectWorker,
+// which carries out the put, commit and close commands sent to it by Put,
+// PutRecord, Commit and Close, and by the timers. Those methods are safe to call
+// from any goroutine; everything else (the fields, and the lowercase methods)
+// must only be used by the owning goroutine.
 type ObjectWorker struct {
 	bucketName         string
 	bytesMax           int64
 	bufferTimeoutMicro int64
 	compression        CompressionType
-	timer              *time.Timer
+	compressionLevel   int
+	compressed         *countingWriter
+	stream             io.WriteCloser
+	encoderFactory     IObjectEncoderFactory
+	header             []byte
+	objectEncoder      IObjectEncoder
+	timer              clockTimer
 	last               time.Time
 	objectPath         string
+	partition          map[string]string
 	tag                string
 	objectTemplate     string
 	Writer             IStorageWriter
 	Written            int64
+
+	// attributes of each object, to which we add the tag (and the compression's content headers)
+	attrs objectAttrs
+
+	// key-encryption key; when set, the compressed stream is encrypted (by encrypter) with a data key per object,
+	// wrapped by this key
+	encryptKey []byte
+	encrypter  io.Closer
+
+	// when true, each put is flushed through the compressor and encrypter to the Writer before it returns, so that
+	// a spool file holds every flush that was acknowledged
+	flushPuts bool
+
+	// when true, each object gets metadata about its records (from span) when it's committed
+	recordStats bool
+	span        recordSpan
+
+	// span of the object being streamed, from beginStreaming to commit; the storage client's own spans are its
+	// children, and the Put and Commit spans link to it
+	objectCtx  context.Context
+	objectSpan trace.Span
+
+	// when set, each object is committed once it holds this many records. The records of a flush go into an
+	// object together, so it may end up with a few more
+	maxRecords int64
+
+	// when set, each object is committed at the end of the wall-clock window (in location) it was begun in, so
+	// that its records were all written in the window its name claims. location also sets the time zone of the
+	// object name's dates; nil for the local time zone
+	rotate      RotateBoundary
+	location    *time.Location
+	windowEnd   time.Time
+	rotateTimer clockTimer
+
+	// when set, each object is committed once it has had no writes for this long. bufferTimeoutMicro (when set)
+	// is the maximum age of an object, however many writes it has
+	idleTimeoutMicro int64
+	idleTimer        clockTimer
+	lastWrite        time.Time
+
+	// the time, and the timers; tests replace it with one they can move
+	clock clock
+
+	// labeled metrics of this worker; nil counts nothing
+	metrics *workerMetrics
+
+	// bytes of the object being written that the worker holds against the process's inFlight budget
+	inFlightHeld int64
+
+	// bytes of records held by objectEncoder that are counted in the buffered metric, until the object ends
+	encoderHeld int64
+
+	// counts the objects begun, so a timer that fires late can tell its object was already committed
+	generation int64
+
+	// commands to the owning goroutine; done is closed when it exits
+	commands chan workerCommand
+	done     chan struct{}
+}
+
+// errWorkerClosed returned by the methods of a worker after Close
+var errWorkerClosed = errors.New("object worker is closed")
+
+// workerOp the kinds of command carried out by a worker's goroutine
+type workerOp int
+
+const (
+	opPut workerOp = iota
+	opPutRecord
+	opCommit
+	opTimeout
+	opIdle
+	opRotate
+	opStatus
+	opClose
+)
+
+// workerCommand one command to a worker's goroutine; the result is sent back on reply (when there is one)
+type workerCommand struct {
+	op        workerOp
+	ctx       context.Context
+	client    IStorageClient
+	buf       bytes.Buffer
+	span      recordSpan
+	tag       string
+	timestamp float64
+	fields    logFields
+
+	// for opTimeout, opIdle and opRotate, the object whose timer expired
+	generation int64
+
+	reply chan workerReply
+}
+
+// workerReply the result of a workerCommand
+type workerReply struct {
+	err    error
+	status WorkerStatus
+}
+
+// WorkerStatus a snapshot of the object a worker is writing
+type WorkerStatus struct {
+	// gs:// url of the object, or "[closed]"
+	Object string
+
+	// bytes written to the object so far
+	Written int64
+
+	// bytes of the object held against the process's inFlight budget
+	InFlight int64
 }
 
 // objectNameData template input data for constructing the object path
@@ -34,19 +159,34 @@ type objectNameData struct {
 	Dd          string
 	IsoDateTime string
 	Mm          string
+	Partition   map[string]string
 	Timestamp   int64
 	Yyyy        string
 	Uuid        uuid.UUID
 }
 
+// newObjectNameData the template input data of an object of the tag and partition, begun at begin
+func newObjectNameData(tag string, begin time.Time, partition map[string]string) objectNameData {
+	return objectNameData{
+		InputTag:    tag,
+		IsoDateTime: begin.UTC().Format("20060102T030405Z"),
+		BeginTime:   begin,
+		Timestamp:   begin.Unix(),
+		Yyyy:        fmt.Sprintf("%d", begin.Year()),
+		Mm:          fmt.Sprintf("%02d", begin.Month()),
+		Dd:          fmt.Sprintf("%02d", begin.Day()),
+		Partition:   partition,
+	}
+}
+
 // String raw struct representation for use in Stringer contexts
 func (ond *objectNameData) String() string {
 	return fmt.Sprintf("%#v", ond)
 }
 
-// NewObjectWorker constructor
+// NewObjectWorker constructor; starts the worker's goroutine, which runs until Close
 func NewObjectWorker(tag, bucketName, objectTemplate string, sizeKiB int64, timeoutSeconds int, compression CompressionType) *ObjectWorker {
-	return &ObjectWorker{
+	work := &ObjectWorker{
 		bucketName:         bucketName,
 		bytesMax:           sizeKiB * 1024,
 		bufferTimeoutMicro: int64(timeoutSeconds) * 1_000_000,
@@ -54,9 +194,59 @@ func NewObjectWorker(tag, bucketName, objectTemplate string, sizeKiB int64, time
 		tag:                tag,
 		objectTemplate:     objectTemplate,
 		Written:            0,
+		clock:              realClock{},
+		commands:           make(chan workerCommand),
+		done:               make(chan struct{}),
+	}
+	go work.run()
+	return work
+}
+
+// run the worker's goroutine: carry out each command in turn, until opClose
+func (work *ObjectWorker) run() {
+	defer close(work.done)
+	for {
+		cmd := <-work.commands
+
+		var reply workerReply
+		switch cmd.op {
+		case opPut:
+			reply.err = work.put(cmd.ctx, cmd.client, cmd.buf, cmd.span)
+		case opPutRecord:
+			reply.err = work.putRecord(cmd.ctx, cmd.client, cmd.tag, cmd.timestamp, cmd.fields)
+		case opCommit, opClose:
+			reply.err = work.commit(context.Background())
+		case opTimeout:
+			reply.err = work.timeout(cmd.generation)
+		case opIdle:
+			reply.err = work.idle(cmd.generation)
+		case opRotate:
+			reply.err = work.rotateWindow(cmd.generation)
+		case opStatus:
+			reply.status = WorkerStatus{Object: work.FormatBucketPath(), Written: work.Written, InFlight: work.inFlightHeld}
+		}
+
+		if cmd.reply != nil {
+			cmd.reply <- reply
+		}
+		if cmd.op == opClose {
+			work.metrics.closed()
+			return
+		}
 	}
 }
 
+// send a command to the worker's goroutine and wait for the result
+func (work *ObjectWorker) send(cmd workerCommand) workerReply {
+	cmd.reply = make(chan workerReply, 1)
+	select {
+	case work.commands <- cmd:
+	case <-work.done:
+		return workerReply{err: errWorkerClosed}
+	}
+	return <-cmd.reply
+}
+
 // produce a gs:// url for the object being written.
 // if no object is currently being written, substitute "[closed]" in place of
 // object name.
@@ -68,100 +258,407 @@ func (work *ObjectWorker) FormatBucketPath() string {
 }
 
 // formatObjectName set the Worker objectPath by applying the template to the current time and input tag
-// we also append ".gz" if the file is gzip-compressed
+// we also append the file extension of an object-buffering format, of the compression (e.g. ".gz"), and ".enc"
+// when the object is encrypted
 func (work *ObjectWorker) formatObjectName() string {
 	tpl, err := template.New("objectPath").Parse(work.objectTemplate)
 	if err != nil { //notest
 		logger.Panic().Msgf("Template '%s' could not be parsed", work.objectTemplate)
 	}
 	buf := new(bytes.Buffer)
-	data := objectNameData{
-		InputTag:    work.tag,
-		IsoDateTime: work.last.UTC().Format("20060102T030405Z"),
-		BeginTime:   work.last,
-		Timestamp:   work.last.Unix(),
-		Yyyy:        fmt.Sprintf("%d", work.last.Year()),
-		Mm:          fmt.Sprintf("%02d", work.last.Month()),
-		Dd:          fmt.Sprintf("%02d", work.last.Day()),
-		Uuid:        uuid.New(),
-	}
+	data := newObjectNameData(work.tag, work.last, work.partition)
+	data.Uuid = uuid.New()
 	if err := tpl.Execute(buf, data); err != nil { //notest
 		logger.Panic().Str("template", work.objectTemplate).Stringer("data", &data).Msgf("Template '%s' could not produce a template filename with %#v", work.objectTemplate, data)
 	}
 
-	if work.compression == CompressionGzip {
-		buf.Write([]byte(".gz"))
+	if work.encoderFactory != nil {
+		buf.WriteString(work.encoderFactory.FileExtension())
+	}
+
+	buf.WriteString(compressionExtension(work.compression))
+
+	if work.encryptKey != nil {
+		buf.WriteString(envelope.Extension)
 	}
 
 	return buf.String()
 }
 
 // beginStreaming initialize a writer to write data to a new bucket object
-func (work *ObjectWorker) beginStreaming(client IStorageClient) {
-	ctx := context.Background()
+//
+// All the data of the object is written through one compressor (stream), which
+// is closed by Commit, so that a compressed object is one well-formed stream.
+// With an encryption key, the compressed stream goes through an envelope
+// encrypter on its way to the Writer.
+func (work *ObjectWorker) beginStreaming(ctx context.Context, client IStorageClient) error {
+	// the compressed (and encrypted) bytes are counted on their way to the Writer, which is attached below
+	compressed := &countingWriter{}
+	var sink io.Writer = compressed
+	var encrypter *envelope.Writer
+	if work.encryptKey != nil {
+		var err error
+		if encrypter, err = envelope.NewWriter(compressed, work.encryptKey); err != nil {
+			return err
+		}
+		sink = encrypter
+	}
+	stream, err := newCompressor(sink, work.compression, work.compressionLevel)
+	if err != nil {
+		return err
+	}
 
-	work.last = time.Now()
+	work.generation++
+	work.last = work.clock.Now()
+	if work.location != nil {
+		work.last = work.last.In(work.location)
+	}
 	work.objectPath = work.formatObjectName()
 
 	work.Written = 0
+	work.span = recordSpan{}
 
-	work.Writer = client.NewWriterFromBucketObjectPath(work.bucketName, work.objectPath, ctx)
+	attrs := work.attrs.withMetadata(map[string]string{metadataTag: work.tag})
+	contentEncoding, contentType := compressionContentHeaders(work.compression)
+	if contentEncoding != "" {
+		attrs.ContentEncoding = contentEncoding
+	}
+	if contentType != "" {
+		attrs.ContentType = contentType
+	}
+	if encrypter != nil {
+		// the content headers describe the plaintext, which the storage service can't read
+		envelopeMetadata := map[string]string{
+			metadataEncryption:      envelope.Algorithm,
+			metadataEncryptionKeyID: envelope.KeyID(work.encryptKey),
+			metadataPlainType:       attrs.ContentType,
+		}
+		if attrs.ContentEncoding != "" {
+			envelopeMetadata[metadataPlainEncoding] = attrs.ContentEncoding
+		}
+		attrs = attrs.withMetadata(envelopeMetadata)
+		attrs.ContentType = "application/octet-stream"
+		attrs.ContentEncoding = ""
+	}
+
+	work.objectCtx, work.objectSpan = tracer.Start(ctx, "ObjectWorker.object", trace.WithAttributes(attrTag.String(work.tag), attrObject.String(work.FormatBucketPath())))
+	work.Writer = client.NewWriterFromBucketObjectPath(work.bucketName, work.objectPath, attrs, work.objectCtx)
 	work.Writer.SetChunkSize(256 * 1024) // this is the smallest chunksize you can set and still have buffering
 
+	compressed.w = work.Writer
+	work.compressed = compressed
+	work.stream = stream
+	work.encrypter = nil
+	if encrypter != nil {
+		work.encrypter = encrypter
+	}
+
+	if work.encoderFactory != nil {
+		work.objectEncoder = work.encoderFactory.NewObjectEncoder()
+	}
+
 	work.startTimer()
+
+	return nil
 }
 
-// startTimer start the idle timer for this worker's write operation
+// startTimer start the timers of the object being begun: its maximum age, its idle timeout, and the end of its window
+//
+// The timers don't commit by themselves; they ask the worker's goroutine to
+// commit the object they were started for.
 func (work *ObjectWorker) startTimer() {
-	expiration := time.Duration(work.bufferTimeoutMicro) * time.Microsecond
+	work.timer, work.idleTimer, work.rotateTimer = nil, nil, nil
+	if work.bufferTimeoutMicro > 0 {
+		work.timer = work.afterFunc(time.Duration(work.bufferTimeoutMicro)*time.Microsecond, opTimeout)
+	}
 
-	work.timer = time.AfterFunc(expiration, func() {
-		dur := expiration.Seconds()
-		logger.Debug().Float64("duration", dur).Str("object", work.FormatBucketPath()).Msgf("committing after %.1fs without a commit", dur)
-		work.Commit()
+	// the idle timer isn't reset by each write; when it fires early, idle starts it again for the time left
+	work.lastWrite = work.last
+	if work.idleTimeoutMicro > 0 {
+		work.idleTimer = work.afterFunc(time.Duration(work.idleTimeoutMicro)*time.Microsecond, opIdle)
+	}
+
+	work.windowEnd = work.rotate.windowEnd(work.last)
+	if !work.windowEnd.IsZero() {
+		work.rotateTimer = work.afterFunc(work.windowEnd.Sub(work.last), opRotate)
+	}
+}
+
+// afterFunc send op, about the object being written now, to the worker's goroutine after d
+func (work *ObjectWorker) afterFunc(d time.Duration, op workerOp) clockTimer {
+	cmd := workerCommand{op: op, generation: work.generation}
+
+	return work.clock.AfterFunc(d, func() {
+		select {
+		case work.commands <- cmd:
+		case <-work.done:
+		}
 	})
 }
 
+// timeout commit the object when it reached its maximum age, unless it was committed (and maybe replaced) in the
+// meantime
+func (work *ObjectWorker) timeout(generation int64) error {
+	if work.Writer == nil || generation != work.generation {
+		return nil
+	}
+
+	dur := (time.Duration(work.bufferTimeoutMicro) * time.Microsecond).Seconds()
+	logger.Debug().Float64("duration", dur).Str("object", work.FormatBucketPath()).Msgf("committing at its maximum age of %.1fs", dur)
+	err := work.commit(context.Background())
+	if err != nil {
+		logger.Error().Str("tag", work.tag).Err(err).Msg("commit after timeout failed")
+	}
+	return err
+}
+
+// idle commit the object when it has had no writes for idleTimeoutMicro, unless it was committed in the meantime.
+// When it was written to since the idle timer started, the timer is started again for the time left
+func (work *ObjectWorker) idle(generation int64) error {
+	if work.Writer == nil || generation != work.generation {
+		return nil
+	}
+
+	timeout := time.Duration(work.idleTimeoutMicro) * time.Microsecond
+	if left := timeout - work.clock.Now().Sub(work.lastWrite); left > 0 {
+		work.idleTimer = work.afterFunc(left, opIdle)
+		return nil
+	}
+
+	logger.Debug().Float64("duration", timeout.Seconds()).Str("object", work.FormatBucketPath()).Msgf("committing after %.1fs without a write", timeout.Seconds())
+	err := work.commit(context.Background())
+	if err != nil {
+		logger.Error().Str("tag", work.tag).Err(err).Msg("commit after idle timeout failed")
+	}
+	return err
+}
+
+// rotateWindow commit the object at the end of its window, unless it was committed in the meantime
+func (work *ObjectWorker) rotateWindow(generation int64) error {
+	if work.Writer == nil || generation != work.generation {
+		return nil
+	}
+
+	logger.Debug().Time("window-end", work.windowEnd).Str("object", work.FormatBucketPath()).Msg("committing at the end of its window")
+	err := work.commit(context.Background())
+	if err != nil {
+		logger.Error().Str("tag", work.tag).Err(err).Msg("commit at the end of the window failed")
+	}
+	return err
+}
+
+// windowClosed whether the object's window has ended, though its timer may not have been handled yet
+func (work *ObjectWorker) windowClosed() bool {
+	return work.Writer != nil && !work.windowEnd.IsZero() && !work.clock.Now().Before(work.windowEnd)
+}
+
+// recordsFull whether the object holds maxRecords records
+func (work *ObjectWorker) recordsFull() bool {
+	return work.maxRecords > 0 && work.span.count >= work.maxRecords
+}
+
 // Put write bytes to a worker
 func (work *ObjectWorker) Put(client IStorageClient, buf bytes.Buffer) error {
-	if work.Writer == nil {
-		work.beginStreaming(client)
+	return work.PutRecords(context.Background(), client, buf, recordSpan{})
+}
+
+// PutRecords write bytes holding some encoded records to a worker, with the count and times of those records.
+// The span of the put is a child of ctx's
+func (work *ObjectWorker) PutRecords(ctx context.Context, client IStorageClient, buf bytes.Buffer, span recordSpan) error {
+	return work.send(workerCommand{op: opPut, ctx: ctx, client: client, buf: buf, span: span}).err
+}
+
+// PutRecord add one decoded record to a worker whose format buffers the whole object (e.g. parquet)
+func (work *ObjectWorker) PutRecord(ctx context.Context, client IStorageClient, tag string, timestamp float64, fields logFields) error {
+	return work.send(workerCommand{op: opPutRecord, ctx: ctx, client: client, tag: tag, timestamp: timestamp, fields: fields}).err
+}
+
+// Commit commit the object being streamed to GCS proper, if there is one
+func (work *ObjectWorker) Commit() error {
+	return work.send(workerCommand{op: opCommit}).err
+}
+
+// Close commit the object being streamed, if there is one, and stop the worker's goroutine.
+// Closing a worker again does nothing.
+func (work *ObjectWorker) Close() error {
+	reply := work.send(workerCommand{op: opClose})
+	<-work.done
+	if reply.err == errWorkerClosed {
+		return nil
 	}
+	return reply.err
+}
 
-	// compress the buffer as we go
-	var mybuffer bytes.Buffer
-	if work.compression == CompressionGzip {
-		gzw := gzip.NewWriter(&mybuffer)
-		io.Copy(gzw, &buf)
-		gzw.Close()
-	} else {
-		mybuffer = buf
+// Status a snapshot of the object being written
+func (work *ObjectWorker) Status() WorkerStatus {
+	return work.send(workerCommand{op: opStatus}).status
+}
+
+// put write bytes to the object, beginning one if needed
+//
+// When this begins a new object, the header (if the format has one) is written first.
+func (work *ObjectWorker) put(ctx context.Context, client IStorageClient, buf bytes.Buffer, span recordSpan) (err error) {
+	ctx, tspan := tracer.Start(ctx, "ObjectWorker.Put", trace.WithAttributes(attrTag.String(work.tag), attrBytes.Int(buf.Len()), attrRecords.Int64(span.count)))
+	defer func() { endSpan(tspan, err) }()
+
+	if work.windowClosed() {
+		if err := work.commit(ctx); err != nil {
+			return err
+		}
+	}
+	if work.Writer == nil {
+		if err := work.beginStreaming(ctx, client); err != nil {
+			return err
+		}
+		if len(work.header) > 0 {
+			buf = *bytes.NewBuffer(append(append([]byte{}, work.header...), buf.Bytes()...))
+		}
 	}
+	tspan.SetAttributes(attrObject.String(work.FormatBucketPath()))
+	tspan.AddLink(trace.LinkFromContext(work.objectCtx))
 
-	// copy input buffer to gcs, and account for #bytes written (after compression)
-	if written, err := io.Copy(work.Writer, &mybuffer); err != nil {
+	// copy input buffer to gcs through the object's compressor, and account for #bytes written (after compression).
+	// The compressor holds some data back until it has enough to compress, so this lags the input a bit.
+	uncompressed, err := io.Copy(work.stream, &buf)
+	if err != nil {
 		return err
-	} else {
-		work.Written += written
 	}
+	if work.flushPuts {
+		if err := work.flushStream(); err != nil {
+			return err
+		}
+	}
+	work.metrics.wrote(uncompressed, work.compressed.n-work.Written)
+	work.Written = work.compressed.n
+	work.holdInFlight(work.Written)
+	work.span.add(span)
+	work.lastWrite = work.clock.Now()
 
-	if work.Written >= work.bytesMax {
-		return work.Commit()
+	if work.Written >= work.bytesMax || work.recordsFull() {
+		return work.commit(ctx)
 	}
 
 	return nil
 }
 
-// Commit commit an object being streamed to GCS proper
-func (work *ObjectWorker) Commit() error {
-	if err := work.Writer.Close(); err != nil {
+// putRecord add one decoded record to the object, beginning one if needed
+//
+// Nothing is written to the bucket until the object is committed, either because
+// its buffered size reaches bytesMax (or it holds maxRecords) or because a timer expires.
+func (work *ObjectWorker) putRecord(ctx context.Context, client IStorageClient, tag string, timestamp float64, fields logFields) error {
+	if work.windowClosed() {
+		if err := work.commit(ctx); err != nil {
+			return err
+		}
+	}
+	if work.Writer == nil {
+		if err := work.beginStreaming(ctx, client); err != nil {
+			return err
+		}
+	}
+
+	if err := work.objectEncoder.AddRecord(tag, timestamp, fields); err != nil {
 		return err
 	}
-	work.timer.Stop()
+	work.span.add(recordSpan{count: 1, first: timestamp, last: timestamp})
+	work.lastWrite = work.clock.Now()
+	work.holdInFlight(work.objectEncoder.Size())
+	work.metrics.holding(work.objectEncoder.Size() - work.encoderHeld)
+	work.encoderHeld = work.objectEncoder.Size()
+
+	if work.objectEncoder.Size() >= work.bytesMax || work.recordsFull() {
+		return work.commit(ctx)
+	}
 
-	logger.Info().Str("object", work.FormatBucketPath()).Float64("kib", float64(work.Written)/1024.0).Msg("committed")
+	return nil
+}
 
-	work.Writer = nil
+// holdInFlight make the bytes the worker holds against the inFlight budget n
+func (work *ObjectWorker) holdInFlight(n int64) {
+	inFlight.hold(n - work.inFlightHeld)
+	work.inFlightHeld = n
+}
 
+// commit finish the object being streamed and commit it to GCS proper; does nothing when there is no object
+//
+// The worker moves on to a new object whatever becomes of this one: when the
+// object can't be finished it is aborted, and when its upload fails it is lost
+// (unless the client keeps a copy to retry).
+func (work *ObjectWorker) commit(ctx context.Context) (err error) {
+	if work.Writer == nil {
+		return nil
+	}
+
+	_, tspan := tracer.Start(ctx, "ObjectWorker.Commit",
+		trace.WithLinks(trace.LinkFromContext(work.objectCtx)),
+		trace.WithAttributes(attrTag.String(work.tag), attrObject.String(work.FormatBucketPath())))
+	defer func() {
+		tspan.SetAttributes(attrBytes.Int64(work.Written), attrRecords.Int64(work.span.count))
+		endSpan(tspan, err)
+	}()
+
+	if err = work.finishStream(); err != nil {
+		// a partial object is never committed
+		work.Writer.Abort()
+	} else {
+		if work.recordStats {
+			work.Writer.SetCommitMetadata(work.span.metadata())
+		}
+		err = work.Writer.Close()
+	}
+	work.endObject(err)
+	return err
+}
+
+// finishStream write out the object of an object-buffering format, and finish the compressed stream and the
+// envelope around it. Each is finished even when one before it failed, and their errors are joined
+func (work *ObjectWorker) finishStream() error {
+	var errs []error
+	var uncompressed int64
+	if work.objectEncoder != nil {
+		n, err := work.objectEncoder.WriteTo(work.stream)
+		uncompressed = n
+		errs = append(errs, err)
+	}
+	errs = append(errs, work.stream.Close())
+	if work.encrypter != nil {
+		errs = append(errs, work.encrypter.Close())
+	}
+	work.metrics.wrote(uncompressed, work.compressed.n-work.Written)
+	work.Written = work.compressed.n
+	return errors.Join(errs...)
+}
+
+// flushStream write out what the compressor, and then the encrypter, hold back, without ending the object
+func (work *ObjectWorker) flushStream() error {
+	for _, w := range []any{work.stream, work.encrypter} {
+		if f, ok := w.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+// endObject stop the timers of the object that was committed (or failed to be), release what it held, and forget it,
+// so the next write begins a new object
+func (work *ObjectWorker) endObject(err error) {
+	for _, timer := range []clockTimer{work.timer, work.idleTimer, work.rotateTimer} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	work.metrics.finished(work.Written, err)
+	work.metrics.holding(-work.encoderHeld)
+	work.encoderHeld = 0
+	work.holdInFlight(0)
+	work.objectSpan.SetAttributes(attrBytes.Int64(work.Written), attrRecords.Int64(work.span.count))
+	endSpan(work.objectSpan, err)
+	if err != nil {
+		logger.Error().Str("object", work.FormatBucketPath()).Float64("kib", float64(work.Written)/1024.0).Err(err).Msg("commit failed")
+	} else {
+		logger.Info().Str("object", work.FormatBucketPath()).Float64("kib", float64(work.Written)/1024.0).Msg("committed")
+	}
+	work.Writer, work.stream, work.encrypter, work.objectEncoder = nil, nil, nil, nil
+}
@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aerospike-managed-cloud-services/flb-output-gcs/envelope"
 	"github.com/google/uuid"
 )
 
@@ -49,6 +54,7 @@ func Test_objectNameData_String(t *testing.T) {
 		Dd:          "17",
 		IsoDateTime: "20220217T001600Z",
 		Mm:          "02",
+		Partition:   map[string]string{"level": "error"},
 		Timestamp:   time.Now().Unix(),
 		Yyyy:        "2022",
 		Uuid:        uuid.New(),
@@ -64,7 +70,7 @@ func Test_objectNameData_String(t *testing.T) {
 	}{
 		{name: "format #1",
 			args: args{&ond},
-			want: `&main.objectNameData{InputTag:"hello", BeginTime:time.Date\(\d{4}, time.[a-zA-Z]+, \d+, \d+, \d+, \d+, \d+, time.Local\), Dd:\"17\", IsoDateTime:\"20220217T001600Z\", Mm:\"02\", Timestamp:\d+, Yyyy:\"2022\", Uuid:uuid.UUID{0x.*?}}`},
+			want: `&main.objectNameData{InputTag:"hello", BeginTime:time.Date\(\d{4}, time.[a-zA-Z]+, \d+, \d+, \d+, \d+, \d+, time.Local\), Dd:\"17\", IsoDateTime:\"20220217T001600Z\", Mm:\"02\", Partition:map\[string\]string{"level":"error"}, Timestamp:\d+, Yyyy:\"2022\", Uuid:uuid.UUID{0x.*?}}`},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -136,13 +142,13 @@ func Test_FormatBucketPath(t *testing.T) {
 func Test_beginStreaming(t *testing.T) {
 	begin := time.Now()
 	ctx := context.Background()
-	cli, _ := sapi.NewClient(ctx)
+	cli, _ := sapi.NewClient(ctx, storageConfig{})
 
 	work1 := newWork1()
 	work1.Written = 19
 	work1.objectPath = "oh-no"
 
-	work1.beginStreaming(cli)
+	work1.beginStreaming(context.Background(), cli)
 
 	// these should be equal, rounded to the nearest minute
 	minute, _ := time.ParseDuration("1m")
@@ -179,33 +185,86 @@ func Test_beginStreaming(t *testing.T) {
 }
 
 // Test_Put_gzip ObjectWorker.Put() with a gzip stream, do we produce the write stream of bytes?
+// Is the object one gzip stream, however many times Put() was called, and do we count the compressed bytes?
 func Test_Put_gzip(t *testing.T) {
 	ctx := context.Background()
-	cli, _ := sapi.NewClient(ctx)
+	cli, _ := sapi.NewClient(ctx, storageConfig{})
 
-	buf := bytes.NewBufferString("abz")
 	work1 := newWork1()
 
-	work1.Put(cli, *buf)
+	work1.Put(cli, *bytes.NewBufferString("abz"))
+	work1.Put(cli, *bytes.NewBufferString("xyz"))
 
 	wri := work1.Writer.(*storageWriterForTest)
+	work1.Commit()
+
+	if work1.Written != int64(wri.buf.Len()) {
+		t.Errorf("Written = %d, but the object has %d bytes", work1.Written, wri.buf.Len())
+	}
+
 	zreader, _ := gzip.NewReader(wri.buf)
 	defer zreader.Close()
-	if bb, _ := ioutil.ReadAll(zreader); !bytes.Equal(bb, []byte{'a', 'b', 'z'}) {
-		t.Errorf("Put() failed, buffer written was '%s'", bb)
+	zreader.Multistream(false)
+	if bb, _ := ioutil.ReadAll(zreader); !bytes.Equal(bb, []byte("abzxyz")) {
+		t.Errorf("Put() failed, first gzip member was '%s'", bb)
+	}
+	if err := zreader.Reset(wri.buf); err != io.EOF {
+		t.Errorf("object has more than one gzip member (%v)", err)
+	}
+}
+
+// Test_Put_encrypted is the compressed stream sealed in an envelope that opens with the key, and labeled as such?
+func Test_Put_encrypted(t *testing.T) {
+	ctx := context.Background()
+	cli, _ := sapi.NewClient(ctx, storageConfig{})
+	kek := bytes.Repeat([]byte{3}, envelope.KeySize)
+
+	work1 := newWork1()
+	defer work1.Close()
+	work1.attrs = objectAttrs{ContentType: "text/csv"}
+	work1.encryptKey = kek
+
+	work1.Put(cli, *bytes.NewBufferString("abz"))
+	wri := work1.Writer.(*storageWriterForTest)
+	if !strings.HasSuffix(work1.objectPath, ".gz.enc") {
+		t.Errorf("object %s should end with .gz.enc", work1.objectPath)
+	}
+	work1.Commit()
+
+	if work1.Written != int64(wri.buf.Len()) {
+		t.Errorf("Written = %d, but the object has %d bytes", work1.Written, wri.buf.Len())
+	}
+	if wri.attrs.ContentEncoding != "" || wri.attrs.ContentType != "application/octet-stream" {
+		t.Errorf("encrypted object has Content-Encoding '%s' and Content-Type '%s'", wri.attrs.ContentEncoding, wri.attrs.ContentType)
+	}
+	md := wri.attrs.Metadata
+	if md[metadataEncryption] != envelope.Algorithm || md[metadataEncryptionKeyID] != envelope.KeyID(kek) || md[metadataPlainType] != "text/csv" || md[metadataPlainEncoding] != "gzip" {
+		t.Errorf("encrypted object metadata %v", md)
+	}
+
+	plain, err := envelope.NewReader(wri.buf, kek)
+	if err != nil {
+		t.Fatalf("envelope.NewReader() %s", err)
+	}
+	zreader, err := gzip.NewReader(plain)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() %s", err)
+	}
+	if bb, err := io.ReadAll(zreader); err != nil || !bytes.Equal(bb, []byte("abz")) {
+		t.Errorf("decrypted object was '%s' (%v)", bb, err)
 	}
 }
 
 // ObjectWorker.Put() with uncompressed stream, and we exceed the byte limit, do we commit automatically?
 func Test_Put_plain_commit(t *testing.T) {
 	ctx := context.Background()
-	cli, _ := sapi.NewClient(ctx)
+	cli, _ := sapi.NewClient(ctx, storageConfig{})
 
 	buf := bytes.NewBufferString("abc")
 	work2 := newWork2()
 	work2.bytesMax = 2
 
-	work2.beginStreaming(cli)
+	work2.beginStreaming(context.Background(), cli)
 	wri := work2.Writer.(*storageWriterForTest)
 	work2.Put(cli, *buf)
 
@@ -218,6 +277,90 @@ func Test_Put_plain_commit(t *testing.T) {
 	}
 }
 
+// Test_PutRecord_writeFails when an object-buffering format can't write its object, is the object aborted rather
+// than committed, and does the next record begin a new object?
+func Test_PutRecord_writeFails(t *testing.T) {
+	ctx := context.Background()
+	cli := &storageClientForTest{}
+	enc := &objectEncoderForTest{failWrite: true}
+	work := newWork2()
+	defer work.Close()
+	work.encoderFactory = enc
+
+	work.PutRecord(ctx, cli, "first", 1, logFields{})
+	first := work.Status().Object
+	if err := work.Commit(); err == nil {
+		t.Fatal("the commit of an object that could not be written succeeded")
+	}
+	if status := work.Status(); status.Object != "[closed]" {
+		t.Errorf("the worker kept %s after its commit failed", status.Object)
+	}
+	for path, wri := range cli.objects {
+		if !wri.aborted {
+			t.Errorf("%s was not aborted", path)
+		}
+	}
+
+	enc.failWrite = false
+	if err := work.PutRecord(ctx, cli, "second", 2, logFields{}); err != nil {
+		t.Fatalf("the record after the failed commit: %s", err)
+	}
+	if second := work.Status().Object; second == first || second == "[closed]" {
+		t.Errorf("the record after the failed commit went to %s", second)
+	}
+	if err := work.Commit(); err != nil {
+		t.Errorf("the next object could not be committed: %s", err)
+	}
+}
+
+// closeFailsForTest a stream that can't be finished
+type closeFailsForTest struct {
+	io.WriteCloser
+}
+
+func (cf closeFailsForTest) Close() error {
+	cf.WriteCloser.Close()
+	return errors.New("injected failure")
+}
+
+// Test_commit_streamFails when the compressed stream can't be finished, is the object aborted, are its timers stopped
+// and its bytes released, and does the next put begin a new object?
+func Test_commit_streamFails(t *testing.T) {
+	defer func(saved *inFlightBudget) { inFlight = saved }(inFlight)
+	inFlight = newInFlightBudget()
+
+	ctx := context.Background()
+	cli := &storageClientForTest{}
+	clk := newClockForTest()
+	work := newWork1()
+	defer work.Close()
+	work.clock = clk
+	work.idleTimeoutMicro = 60_000_000
+
+	work.put(ctx, cli, *bytes.NewBufferString("abc"), recordSpan{count: 1})
+	wri := work.Writer.(*storageWriterForTest)
+	work.stream = closeFailsForTest{work.stream}
+	if err := work.commit(ctx); err == nil {
+		t.Fatal("the commit of an unfinished stream succeeded")
+	}
+
+	if !wri.aborted || work.Writer != nil || work.stream != nil {
+		t.Errorf("the object was not aborted and forgotten (aborted %v)", wri.aborted)
+	}
+	for _, timer := range clk.timers {
+		if !timer.stopped {
+			t.Errorf("a timer at %s is still running", timer.at)
+		}
+	}
+	if held := inFlight.heldBytes(); held != 0 {
+		t.Errorf("%d bytes still held", held)
+	}
+
+	if err := work.put(ctx, cli, *bytes.NewBufferString("xyz"), recordSpan{count: 1}); err != nil || work.Writer == wri {
+		t.Errorf("the put after the failed commit did not begin a new object (%v)", err)
+	}
+}
+
 // Test_timerExpired do we commit automatically when a timer expires?
 func Test_timerExpired(t *testing.T) {
 	work2 := newWork2()
@@ -225,18 +368,198 @@ func Test_timerExpired(t *testing.T) {
 
 	ctx := context.Background()
 	sapi := &storageAPIForTest{}
-	cli, _ := sapi.NewClient(ctx)
-	work2.beginStreaming(cli)
+	cli, _ := sapi.NewClient(ctx, storageConfig{})
+	work2.Put(cli, *bytes.NewBufferString("abc"))
+
+	t.Log("waiting up to 1s for the timer (0.003ms) to expire")
+	deadline := time.Now().Add(time.Second)
+	for work2.Status().Object != "[closed]" && time.Now().Before(deadline) {
+		time.Sleep(1 * time.Millisecond)
+	}
 
-	if work2.Writer == nil {
-		t.Error("work2.Writer was nil after calling beginStreaming, something's up")
+	if got := work2.Status().Object; got != "[closed]" {
+		t.Errorf("%s was left open after the timer expiration should have caused a commit", got)
 	}
+}
 
-	t.Log("sleeping for 1ms to force the timer (0.003ms) to expire")
-	time.Sleep(1 * time.Millisecond)
+// Test_idleTimeout is the object committed once it has had no writes for IdleTimeoutSeconds, however old it is,
+// and not while it's being written to?
+func Test_idleTimeout(t *testing.T) {
+	clk := newClockForTest()
+	cli := &storageClientForTest{}
+	work2 := newWork2()
+	defer work2.Close()
+	work2.clock = clk
+	work2.bufferTimeoutMicro = 0
+	work2.idleTimeoutMicro = 10_000_000
+
+	work2.Put(cli, *bytes.NewBufferString("abc"))
+	for i := 0; i < 5; i++ {
+		clk.Advance(6 * time.Second)
+		work2.Put(cli, *bytes.NewBufferString("abc"))
+	}
+	if got := work2.Status().Object; got == "[closed]" {
+		t.Fatal("the object was committed while it was being written to")
+	}
 
-	if work2.Writer != nil {
-		t.Error("work2.Writer was left dangling after the timer expiration should have caused a commit")
+	clk.Advance(9 * time.Second)
+	if got := work2.Status().Object; got == "[closed]" {
+		t.Fatal("the object was committed 9s after its last write")
+	}
+	clk.Advance(1 * time.Second)
+	if got := work2.Status().Object; got != "[closed]" {
+		t.Errorf("%s was left open 10s after its last write", got)
+	}
+	if len(cli.objects) != 1 {
+		t.Errorf("%d objects were begun, wanted 1", len(cli.objects))
+	}
+}
+
+// Test_maxObjectAge is the object committed MaxObjectAgeSeconds after it began, however busy it is, and the next
+// one given its own maximum age?
+func Test_maxObjectAge(t *testing.T) {
+	clk := newClockForTest()
+	cli := &storageClientForTest{}
+	work2 := newWork2()
+	defer work2.Close()
+	work2.clock = clk
+	work2.bufferTimeoutMicro = 30_000_000
+	work2.idleTimeoutMicro = 10_000_000
+
+	work2.Put(cli, *bytes.NewBufferString("abc"))
+	for i := 0; i < 5; i++ {
+		clk.Advance(5 * time.Second)
+		work2.Put(cli, *bytes.NewBufferString("abc"))
+	}
+	if got := work2.Status().Object; got == "[closed]" {
+		t.Fatal("the object was committed before its maximum age")
+	}
+	clk.Advance(5 * time.Second)
+	if got := work2.Status().Object; got != "[closed]" {
+		t.Fatalf("%s was left open at its maximum age", got)
 	}
 
+	work2.Put(cli, *bytes.NewBufferString("def"))
+	clk.Advance(5 * time.Second)
+	if got := work2.Status().Object; got == "[closed]" {
+		t.Error("the next object was committed at the maximum age of the first")
+	}
+	if len(cli.objects) != 2 {
+		t.Errorf("%d objects were begun, wanted 2", len(cli.objects))
+	}
+}
+
+// Test_Put_maxRecords do we commit once an object holds MaxRecords records, and begin the next one for the
+// records after that?
+func Test_Put_maxRecords(t *testing.T) {
+	cli := &storageClientForTest{}
+	work2 := newWork2()
+	defer work2.Close()
+	work2.maxRecords = 3
+
+	for i := 0; i < 4; i++ {
+		work2.PutRecords(context.Background(), cli, *bytes.NewBufferString("line\n"), recordSpan{count: 1})
+	}
+
+	if len(cli.objects) != 2 {
+		t.Fatalf("%d objects were begun for 4 records, wanted 2", len(cli.objects))
+	}
+	if got := work2.Status(); got.Written != int64(len("line\n")) {
+		t.Errorf("the second object has %d bytes, wanted the 4th record only", got.Written)
+	}
+}
+
+// Test_Put_rotateOnBoundary is the object committed at the end of its window, by its timer or by the first put
+// after the window ended (whichever comes first), and are the object's dates in the window's time zone?
+func Test_Put_rotateOnBoundary(t *testing.T) {
+	kolkata, _ := time.LoadLocation("Asia/Kolkata")
+	cli := &storageClientForTest{}
+	work2 := newWork2()
+	defer work2.Close()
+	work2.rotate = RotateMinute
+	work2.location = kolkata
+
+	work2.Put(cli, *bytes.NewBufferString("abc"))
+	if work2.last.Location() != kolkata {
+		t.Errorf("the object began at %s, not in the window's time zone", work2.last)
+	}
+	if want := work2.rotate.windowEnd(work2.last); !work2.windowEnd.Equal(want) || work2.rotateTimer == nil {
+		t.Fatalf("window ends at %s, wanted %s", work2.windowEnd, want)
+	}
+
+	// as if the timer at the end of the window hadn't been handled yet
+	work2.rotateTimer.Stop()
+	work2.windowEnd = time.Now().Add(-time.Second)
+	first := work2.Writer.(*storageWriterForTest)
+	work2.Put(cli, *bytes.NewBufferString("def"))
+
+	if first.buf.String() != "abc" || work2.Writer == IStorageWriter(first) {
+		t.Errorf("the first object was '%s', and still open: %v; wanted 'abc', committed", first.buf.String(), work2.Writer == IStorageWriter(first))
+	}
+	if len(cli.objects) != 2 {
+		t.Errorf("%d objects were begun, wanted 2", len(cli.objects))
+	}
+
+	// the timer at the end of the window commits the object
+	work2.rotateTimer.Stop()
+	work2.rotateTimer = work2.afterFunc(time.Microsecond, opRotate)
+	deadline := time.Now().Add(time.Second)
+	for work2.Status().Object != "[closed]" && time.Now().Before(deadline) {
+		time.Sleep(1 * time.Millisecond)
+	}
+	if got := work2.Status().Object; got != "[closed]" {
+		t.Errorf("%s was left open at the end of its window", got)
+	}
+}
+
+// Test_ObjectWorker_concurrent do Put, Commit and the timer, all at once from several goroutines, lose or
+// garble any data? Run with -race.
+func Test_ObjectWorker_concurrent(t *testing.T) {
+	cli := &storageClientForTest{}
+
+	work2 := newWork2()
+	work2.bufferTimeoutMicro = 50
+	work2.bytesMax = 64
+
+	const putters, puts = 8, 200
+	var wg sync.WaitGroup
+	for p := 0; p < putters; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < puts; i++ {
+				if err := work2.Put(cli, *bytes.NewBufferString("line\n")); err != nil {
+					t.Errorf("Put() %s", err)
+				}
+				switch i % 50 {
+				case 0:
+					work2.Commit()
+				case 25:
+					work2.Status()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := work2.Close(); err != nil {
+		t.Errorf("Close() %s", err)
+	}
+	if err := work2.Put(cli, *bytes.NewBufferString("late\n")); err != errWorkerClosed {
+		t.Errorf("Put() after Close() returned %v", err)
+	}
+	if err := work2.Close(); err != nil {
+		t.Errorf("second Close() %s", err)
+	}
+
+	total := 0
+	for path, wri := range cli.objects {
+		if strings.Trim(wri.buf.String(), "line\n") != "" {
+			t.Errorf("%s is garbled: '%s'", path, wri.buf.String())
+		}
+		total += wri.buf.Len()
+	}
+	if want := putters * puts * len("line\n"); total != want {
+		t.Errorf("%d bytes were written to %d objects, wanted %d", total, len(cli.objects), want)
+	}
 }
@@ -4,15 +4,25 @@ import (
 	"C"
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 	"unsafe"
 
+	"github.com/aerospike-managed-cloud-services/flb-output-gcs/envelope"
 	"github.com/fluent/fluent-bit-go/output"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // outputState Settings for this output plugin instance.
@@ -21,30 +31,202 @@ import (
 // The organization of fluent-bit permits multiple output plugins routing
 // different data to different places, but within each stream of events
 // you can have multiple inputs, each of which gets its own worker here.
+//
+// Each instance has one outputState, registered in instances by its outputID;
+// fluent-bit's context of the instance holds only the outputID. With fluent-bit's
+// `workers`, an instance is flushed from several threads at once, so the
+// workers map (with its lru, the buckets, and exited) are guarded by mutex, and the rest is only set by
+// FLBPluginInit.
 type outputState struct {
-	// name of the bucket
-	// required, no default
+	// object store the objects are written to, allowed values: gcs; s3; azure; local
+	// default "gcs"
+	backend StorageBackend
+
+	// name of the bucket (the container, for azure; a subdirectory of localDir, for local). with bucketTemplate,
+	// the bucket of the records whose bucket can't be rendered or checked
+	// required (unless bucketTemplate is set), no default
 	bucket string
 
+	// template of the bucket of each record, rendered with the data of objectNameTemplate (at the time of the flush)
+	// and the record's fields, as .Record.<key>. each bucket is checked the first time it's used
+	// default none, every record goes to bucket
+	bucketTemplate *template.Template
+
 	// maximum size (in KiB) held in the request Writer buffer before committing an object to the bucket
 	// default 5000
 	bufferSizeKiB int64
 
-	// maximum time (in s) between writes before the request Writer must commit to the bucket
-	// (even if bufferSizeKiB has not been reached)
+	// maximum age (in s) of an object, from its first write, before it is committed to the bucket however many
+	// writes it has had (even if bufferSizeKiB has not been reached); 0 for no maximum. MaxObjectAgeSeconds, or
+	// BufferTimeoutSeconds, its old name
 	// default 300
 	bufferTimeoutSeconds int
 
-	// compression type, allowed values: none; gzip
+	// number of times to retry an upload that failed, before giving up on the object
+	// default 5
+	commitRetries int
+
+	// Cache-Control of each object
+	// default ""
+	cacheControl string
+
+	// compression type, allowed values: none; gzip; zstd; snappy; lz4
 	// default "none"
 	compression CompressionType
 
-	// internal-use; connectable google storage api client
+	// compression level; 0 for the default of each compression type
+	// default 0
+	compressionLevel int
+
+	// path of a service account key (JSON) for the gcs backend. blank for the application default credentials
+	// default ""
+	credentialsFile string
+
+	// the service account key (JSON) itself, usually from an environment variable as ${VAR}; takes the place of
+	// credentialsFile
+	// default ""
+	credentialsJSON string
+
+	// service accounts in the delegation chain from our credentials to the impersonated one
+	// default none
+	delegates []string
+
+	// local directory where objects we gave up on uploading are kept. blank to drop them
+	// default ""
+	deadLetterDir string
+
+	// key-encryption key of the client-side envelope encryption, read from EncryptKeyFile when Encrypt is on; each
+	// object is encrypted before upload with its own data key, wrapped by this one
+	// default none
+	encryptKey []byte
+
+	// customer-supplied AES-256 key (CSEK) that encrypts each object, read from EncryptionKeyFile
+	// default none
+	encryptionKey []byte
+
+	// URL of the storage service, e.g. a gcs emulator. blank for the usual one (GCS, AWS S3, or the azure account's
+	// blob service)
+	// default ""
+	endpoint string
+
+	// internal-use; serializes each decoded record according to format
+	encoder IRecordEncoder
+
+	// record format written to objects, allowed values: legacy; json_lines; csv; tsv; parquet; avro
+	// default "legacy"
+	format FormatType
+
+	// internal-use; connectable google storage api client (or the client of another backend)
 	gcsClient IStorageClient
 
+	// time (in s) without a write after which an object is committed to the bucket; 0 for no idle timeout
+	// default 0
+	idleTimeoutSeconds int
+
+	// email of a service account to impersonate with our credentials, so each instance can write as its own identity
+	// default ""
+	impersonate string
+
+	// maximum time (in s) a flush waits for room under maxInFlightBytes before returning FLB_RETRY
+	// default 0
+	inFlightWaitSeconds int
+
+	// root directory of the local backend
+	// default "", required for the local backend
+	localDir string
+
+	// name of the customer-managed (KMS) key that encrypts each object, e.g.
+	// projects/p/locations/l/keyRings/r/cryptoKeys/k. blank for the bucket's default encryption
+	// default ""
+	kmsKeyName string
+
+	// maximum number of bytes held in the process (by every instance) that aren't uploaded yet; the open objects
+	// holding the most are committed, or flushes are retried, while there are more. the first instance that sets it
+	// sets the limit of the process. 0 for no limit
+	// default 0
+	maxInFlightBytes int64
+
+	// maximum number of records in an object before it is committed; 0 for no limit
+	// default 0
+	maxRecords int64
+
+	// maximum number of workers (one per tag and partition) kept open; the least recently used is closed to make
+	// room for another. 0 for no limit
+	// default 0
+	maxWorkers int
+
+	// host:port of the process's metrics listener, e.g. ":2021"; the first instance that sets it starts the one
+	// listener, which serves the metrics of every instance
+	// default "", no listener
+	metricsAddress string
+
+	// custom metadata of each object, besides the host, tag and plugin version we add
+	// default none
+	metadata map[string]string
+
+	// when true, each object also gets metadata with the number of records, and the time of the first and last
+	// default false
+	metadataRecordStats bool
+
+	// when true, gcs requests are sent without credentials, e.g. to an emulator
+	// default false
+	noAuth bool
+
+	// where the plugin's spans, and its metrics, are exported: none or otlp
+	// default none
+	otelExporter TelemetryExporter
+
+	// URL of the OTLP/HTTP collector, e.g. http://collector:4318. blank for the OTEL_EXPORTER_OTLP_* environment
+	// variables, or else http://localhost:4318
+	// default ""
+	otelEndpoint string
+
 	// string to uniquely identify this output plugin instance
 	outputID string
 
+	// gcs project billed for the requests (the quota project). blank for the project of the credentials
+	// default ""
+	projectID string
+
+	// s3 region. blank to look it up
+	// default ""
+	region string
+
+	// maximum size (in KiB) of an object kept in memory so its upload can be retried, when there is no spoolDir
+	// default 2 * bufferSizeKiB
+	retryBufferKiB int64
+
+	// seconds to wait before the first retry of a failed upload; doubled for each retry after that (up to 60)
+	// default 1
+	retryBackoffSeconds int
+
+	// record keys whose values partition the objects; each tag and combination of values gets its own worker,
+	// and the values are available to objectNameTemplate as .Partition.<key>
+	// default none
+	partitionKeys []string
+
+	// wall-clock window each object is committed at the end of, allowed values: none; minute; hour; day
+	// default "none"
+	rotateOnBoundary RotateBoundary
+
+	// time zone of the windows of rotateOnBoundary, and of the dates in object names; nil when there are no windows
+	// default UTC
+	rotateTimeZone *time.Location
+
+	// maximum time (in s) to wait at exit for the open objects to be committed and uploaded; what's left after that
+	// is kept in the spool for the next start (or in deadLetterDir, to be uploaded by hand)
+	// default 30
+	shutdownTimeoutSeconds int
+
+	// local directory where objects are written before they are uploaded; each instance uses a subdirectory
+	// named by its outputID. blank to stream directly to the bucket
+	// default ""
+	spoolDir string
+
+	// storage class of each object, e.g. NEARLINE (or the access tier, for azure). blank for the bucket's default
+	// default ""
+	storageClass string
+
 	// a template for the object filename that gets created in the bucket. this uses golang text/template syntax.
 	// The following placeholders are recognized:
 	// {{ .InputTag }} the tag of the associated fluent "input" being flushed, e.g. "cpu"
@@ -52,22 +234,60 @@ type outputState struct {
 	// {{ .IsoDateTime }} 14-digit YYYYmmddTHHMMSSZ datetime format, UTC
 	// {{ .Yyyy }} {{ .Mm }} {{ .Dd }} year, month, day
 	// {{ .Uuid }} a random UUID
+	// {{ .Partition.<key> }} the value of one of partitionKeys in the object's records
 	// {{ .BeginTime.Format "2006...." }} .beginTime is a time.Time() object and you can use any method on it;
 	// 								      for example, you can call .Format() as shown and get any format you want
 	// The object created will be in gs://BUCKET/
 	// default "{{ .InputTag }}-{{ .Timestamp }}-{{ .Uuid }}"
 	objectNameTemplate string
 
-	// internal-use; map of inputTag to a gcs api client worker
+	// name of the key holding the input tag in each json_lines record
+	// default "tag"
+	tagKey string
+
+	// name of the key holding the record timestamp in each json_lines record
+	// default "timestamp"
+	timeKey string
+
+	// internal-use; when the format buffers each whole object (parquet), makes the per-object encoder.
+	// nil for streaming formats
+	objectEncoder IObjectEncoderFactory
+
+	// time (in s) a worker goes unused before it is closed and forgotten; 0 to keep every worker until exit
+	// default 600
+	workerIdleSeconds int
+
+	// internal-use; map of inputTag (and partition values) to a gcs api client worker
 	workers map[string](*ObjectWorker)
+
+	// internal-use; the keys of workers, in order of use
+	lru *workerLRU
+
+	// internal-use; the number of flushes writing to each worker, which isn't evicted while any is
+	pins map[string]int
+
+	// internal-use; the buckets of bucketTemplate that were checked
+	buckets map[string]bucketCheck
+
+	// internal-use; nil for the time of day
+	clock clock
+
+	// internal-use; true once the instance was shut down at exit
+	exited bool
+
+	// internal-use; guards workers, lru, pins, buckets and exited
+	mutex sync.Mutex
 }
 
-// CompressionType gzip or none
+// CompressionType gzip, zstd, snappy, lz4 or none
 type CompressionType string
 
 const (
-	CompressionNone CompressionType = "none"
-	CompressionGzip CompressionType = "gzip"
+	CompressionNone   CompressionType = "none"
+	CompressionGzip   CompressionType = "gzip"
+	CompressionZstd   CompressionType = "zstd"
+	CompressionSnappy CompressionType = "snappy"
+	CompressionLz4    CompressionType = "lz4"
 )
 
 const (
@@ -75,10 +295,31 @@ const (
 )
 
 var (
-	VERSION   string                    // to set this, build with --ldflags="-X main.VERSION=vx.y.z"
-	instances map[string](*outputState) = make(map[string](*outputState))
+	VERSION string // to set this, build with --ldflags="-X main.VERSION=vx.y.z"
+
+	// the output instances, by outputID
+	instances      map[string](*outputState) = make(map[string](*outputState))
+	instancesMutex sync.Mutex
 )
 
+// registerInstance add an output instance to instances, unless another has its outputID
+func registerInstance(state *outputState) error {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+	if _, exists := instances[state.outputID]; exists {
+		return fmt.Errorf("OutputID %s is used by more than one [OUTPUT] block", state.outputID)
+	}
+	instances[state.outputID] = state
+	return nil
+}
+
+// lookupInstance the output instance with outputID, or nil
+func lookupInstance(outputID string) *outputState {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+	return instances[outputID]
+}
+
 // flbAPI global access to the fluent-bit API through this object
 var flbAPI IFLBOutputAPI = &flbOutputAPIWrapper{}
 
@@ -112,6 +353,26 @@ func pluginConfigValueToInt(plugin unsafe.Pointer, skey string) (int64, bool) {
 	}
 }
 
+// pluginConfigValueToBool convert a plugin config string (true/false, on/off, yes/no) to bool or return (, false)
+// to accept the default
+func pluginConfigValueToBool(plugin unsafe.Pointer, skey string) (bool, bool) {
+	sval := flbAPI.FLBPluginConfigKey(plugin, skey)
+
+	switch strings.ToLower(sval) {
+	case "":
+		// empty -> use the default
+		return false, false
+	case "true", "on", "yes", "1":
+		return true, true
+	case "false", "off", "no", "0":
+		return false, true
+	}
+
+	// can't parse; warn, and use the default
+	logger.Warn().Str(skey, sval).Msg("option value should be true or false, using default")
+	return false, false
+}
+
 // getConfigStrRequired get a string value from the config, enforcing that it is set
 func getConfigStrRequired(plugin unsafe.Pointer, skey string) string {
 	var val string
@@ -143,14 +404,45 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 	}
 
 	// [OUTPUT] sections for the gcs plugin must have these fields
-	bucket := getConfigStrRequired(plugin, "Bucket")
+	bucketTemplate := flbAPI.FLBPluginConfigKey(plugin, "BucketTemplate")
+	bucket := flbAPI.FLBPluginConfigKey(plugin, "Bucket")
+	if bucketTemplate == "" {
+		bucket = getConfigStrRequired(plugin, "Bucket")
+	}
 	outputID := getConfigStrRequired(plugin, "OutputID")
 
 	objectNameTemplate := getConfigStrDefault(plugin, "ObjectNameTemplate", "{{ .InputTag }}-{{ .Timestamp }}")
 
-	// create a GCS API client for this output instance, or die
+	// which object store to write to
+	storage := storageConfig{
+		backend:         BackendGCS,
+		endpoint:        flbAPI.FLBPluginConfigKey(plugin, "Endpoint"),
+		credentialsFile: flbAPI.FLBPluginConfigKey(plugin, "CredentialsFile"),
+		credentialsJSON: flbAPI.FLBPluginConfigKey(plugin, "CredentialsJSON"),
+		impersonate:     flbAPI.FLBPluginConfigKey(plugin, "ImpersonateServiceAccount"),
+		delegates:       parseColumnList(flbAPI.FLBPluginConfigKey(plugin, "ImpersonateDelegates")),
+		projectID:       flbAPI.FLBPluginConfigKey(plugin, "ProjectID"),
+		region:          flbAPI.FLBPluginConfigKey(plugin, "Region"),
+		localDir:        flbAPI.FLBPluginConfigKey(plugin, "LocalDir"),
+	}
+	if noAuth, ok := pluginConfigValueToBool(plugin, "NoAuth"); ok {
+		storage.noAuth = noAuth
+	}
+	if storage.credentialsJSON != "" && storage.credentialsFile != "" {
+		logger.Warn().Str("CredentialsFile", storage.credentialsFile).Msg("both CredentialsJSON and CredentialsFile are set; using CredentialsJSON")
+	}
+	if backend := flbAPI.FLBPluginConfigKey(plugin, "Backend"); backend != "" {
+		switch StorageBackend(backend) {
+		case BackendGCS, BackendS3, BackendAzure, BackendLocal:
+			storage.backend = StorageBackend(backend)
+		default:
+			logger.Warn().Msgf("'Backend %s' should be 'gcs', 's3', 'azure' or 'local'; using default", backend)
+		}
+	}
+
+	// create a storage API client for this output instance, or die
 	gcsctx := context.Background()
-	client, err := storageAPI.NewClient(gcsctx)
+	client, err := storageAPI.NewClient(gcsctx, storage)
 	if err != nil {
 		flbAPI.FLBPluginUnregister(plugin)
 		logger.Fatal().Msgf("FLBPluginInit() NewStorageClient() %s", err.Error())
@@ -158,14 +450,31 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 	}
 
 	// parse configuration for this output instance
-	ost := outputState{
+	ost := &outputState{
+		backend:              storage.backend,
 		bucket:               bucket,
 		bufferSizeKiB:        5000,
 		bufferTimeoutSeconds: 300,
+		commitRetries:        5,
 		compression:          CompressionNone,
+		credentialsFile:      storage.credentialsFile,
+		credentialsJSON:      storage.credentialsJSON,
+		delegates:            storage.delegates,
+		endpoint:             storage.endpoint,
+		format:               FormatLegacy,
 		gcsClient:            client,
+		impersonate:          storage.impersonate,
+		localDir:             storage.localDir,
+		noAuth:               storage.noAuth,
+		otelExporter:         ExporterNone,
 		outputID:             outputID,
 		objectNameTemplate:   objectNameTemplate,
+		projectID:            storage.projectID,
+		region:               storage.region,
+		retryBackoffSeconds:  1,
+		rotateOnBoundary:     RotateNone,
+		tagKey:               "tag",
+		timeKey:              "timestamp",
 
 		// initialize workers; this instance will eventually add 1 worker per input to this map
 		workers: map[string]*ObjectWorker{},
@@ -178,21 +487,320 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 	if bts, ok := pluginConfigValueToInt(plugin, "BufferTimeoutSeconds"); ok {
 		ost.bufferTimeoutSeconds = int(bts)
 	}
+	if age, ok := pluginConfigValueToInt(plugin, "MaxObjectAgeSeconds"); ok {
+		ost.bufferTimeoutSeconds = int(age)
+	}
+	if idle, ok := pluginConfigValueToInt(plugin, "IdleTimeoutSeconds"); ok {
+		ost.idleTimeoutSeconds = int(idle)
+	}
+	if ost.bufferTimeoutSeconds <= 0 && ost.idleTimeoutSeconds <= 0 {
+		logger.Warn().Msg("neither MaxObjectAgeSeconds nor IdleTimeoutSeconds is set; objects of a quiet tag may stay open until exit")
+	}
+
+	if mr, ok := pluginConfigValueToInt(plugin, "MaxRecords"); ok {
+		ost.maxRecords = mr
+	}
+
+	if mifb, ok := pluginConfigValueToInt(plugin, "MaxInFlightBytes"); ok && mifb > 0 {
+		ost.maxInFlightBytes = mifb
+		if limit := inFlight.setMax(mifb); limit != mifb {
+			logger.Warn().Int64("MaxInFlightBytes", mifb).Int64("limit", limit).Msg("MaxInFlightBytes is already set by another output; one limit serves every output")
+		}
+	}
+	if ifws, ok := pluginConfigValueToInt(plugin, "InFlightWaitSeconds"); ok {
+		ost.inFlightWaitSeconds = int(ifws)
+	}
+
+	ost.workerIdleSeconds = 600
+	if wis, ok := pluginConfigValueToInt(plugin, "WorkerIdleSeconds"); ok {
+		ost.workerIdleSeconds = int(wis)
+	}
+	if mw, ok := pluginConfigValueToInt(plugin, "MaxWorkers"); ok {
+		ost.maxWorkers = int(mw)
+	}
+	if ost.maxInFlightBytes > 0 && ost.maxInFlightBytes <= ost.bufferSizeKiB*1024*int64(max(ost.maxWorkers, 1)) {
+		logger.Warn().Int64("MaxInFlightBytes", ost.maxInFlightBytes).Int64("BufferSizeKiB", ost.bufferSizeKiB).Int("MaxWorkers", ost.maxWorkers).Msg("MaxInFlightBytes should be more than BufferSizeKiB for each worker (MaxWorkers, or 1); objects will be committed before they are full to make room")
+	}
+
+	if boundary := flbAPI.FLBPluginConfigKey(plugin, "RotateOnBoundary"); boundary != "" {
+		switch RotateBoundary(boundary) {
+		case RotateNone, RotateMinute, RotateHour, RotateDay:
+			ost.rotateOnBoundary = RotateBoundary(boundary)
+		default:
+			logger.Warn().Msgf("'RotateOnBoundary %s' should be 'minute', 'hour', 'day' or 'none'; using default", boundary)
+		}
+	}
+	zone := flbAPI.FLBPluginConfigKey(plugin, "RotateTimeZone")
+	if ost.rotateOnBoundary != RotateNone {
+		ost.rotateTimeZone = time.UTC
+		if zone != "" {
+			if loc, err := time.LoadLocation(zone); err != nil {
+				logger.Warn().Err(err).Msgf("'RotateTimeZone %s' is not a known time zone; using default", zone)
+			} else {
+				ost.rotateTimeZone = loc
+			}
+		}
+	} else if zone != "" {
+		logger.Warn().Msg("RotateTimeZone is set, but RotateOnBoundary is not; it is ignored")
+	}
 
 	if cmpr := flbAPI.FLBPluginConfigKey(plugin, "Compression"); cmpr != "" {
 		switch CompressionType(cmpr) {
-		case CompressionNone:
+		case CompressionNone, CompressionGzip, CompressionZstd, CompressionSnappy, CompressionLz4:
+			ost.compression = CompressionType(cmpr)
+		default:
+			logger.Warn().Msgf("'Compression %s' should be 'gzip', 'zstd', 'snappy', 'lz4' or 'none'; using default", cmpr)
+		}
+	}
+
+	if lvl, ok := pluginConfigValueToInt(plugin, "CompressionLevel"); ok {
+		ost.compressionLevel = int(lvl)
+		// every object opens a compressor at this level, so find out now whether it can. A zstd compressor has
+		// goroutines of its own until it's closed
+		if cmpr, err := newCompressor(io.Discard, ost.compression, ost.compressionLevel); err != nil {
+			logger.Warn().Err(err).Msgf("'CompressionLevel %d' can't be used; using default", lvl)
+			ost.compressionLevel = 0
+		} else {
+			cmpr.Close()
+		}
+	}
+
+	if fmtName := flbAPI.FLBPluginConfigKey(plugin, "Format"); fmtName != "" {
+		switch FormatType(fmtName) {
+		case FormatLegacy:
+			ost.format = FormatLegacy
+		case FormatJSONLines:
+			ost.format = FormatJSONLines
+		case FormatCSV:
+			ost.format = FormatCSV
+		case FormatTSV:
+			ost.format = FormatTSV
+		case FormatParquet:
+			ost.format = FormatParquet
+		case FormatAvro:
+			ost.format = FormatAvro
+		default:
+			logger.Warn().Msgf("'Format %s' should be 'legacy', 'json_lines', 'csv', 'tsv', 'parquet' or 'avro'; using default", fmtName)
+		}
+	}
+
+	ost.tagKey = getConfigStrDefault(plugin, "TagKey", ost.tagKey)
+	ost.timeKey = getConfigStrDefault(plugin, "TimeKey", ost.timeKey)
+
+	ost.encoder = NewRecordEncoder(ost.format, ost.timeKey, ost.tagKey)
+
+	switch ost.format {
+	case FormatCSV, FormatTSV:
+		csvenc := &csvEncoder{
+			columns: parseColumnList(getConfigStrRequired(plugin, "Columns")),
+			comma:   ',',
+			extra:   CsvExtraKeysIgnore,
+			missing: CsvMissingEmpty,
+			timeKey: ost.timeKey,
+			tagKey:  ost.tagKey,
+		}
+		if ost.format == FormatTSV {
+			csvenc.comma = '\t'
+		}
+		if policy := flbAPI.FLBPluginConfigKey(plugin, "CsvExtraKeys"); policy != "" {
+			switch CsvExtraKeysPolicy(policy) {
+			case CsvExtraKeysIgnore, CsvExtraKeysReject, CsvExtraKeysCollect:
+				csvenc.extra = CsvExtraKeysPolicy(policy)
+			default:
+				logger.Warn().Msgf("'CsvExtraKeys %s' should be 'ignore', 'reject' or 'collect'; using default", policy)
+			}
+		}
+		if policy := flbAPI.FLBPluginConfigKey(plugin, "CsvMissingColumns"); policy != "" {
+			switch CsvMissingPolicy(policy) {
+			case CsvMissingEmpty, CsvMissingReject:
+				csvenc.missing = CsvMissingPolicy(policy)
+			default:
+				logger.Warn().Msgf("'CsvMissingColumns %s' should be 'empty' or 'reject'; using default", policy)
+			}
+		}
+		ost.encoder = csvenc
+
+	case FormatParquet:
+		pqcfg := &parquetEncoderConfig{
+			compression:  ost.compression,
+			rowGroupSize: 10000,
+			timeKey:      ost.timeKey,
+			tagKey:       ost.tagKey,
+		}
+		if rgs, ok := pluginConfigValueToInt(plugin, "ParquetRowGroupSize"); ok {
+			pqcfg.rowGroupSize = rgs
+		}
+		if spec := flbAPI.FLBPluginConfigKey(plugin, "ParquetSchema"); spec != "" {
+			if cols, err := parseParquetSchema(spec); err != nil {
+				logger.Warn().Err(err).Msgf("'ParquetSchema %s' could not be parsed; inferring the schema instead", spec)
+			} else {
+				pqcfg.columns = cols
+			}
+		}
+		ost.objectEncoder = pqcfg
+
+	case FormatAvro:
+		if ost.compression == CompressionLz4 {
+			logger.Warn().Msg("avro has no 'lz4' block codec; using none")
 			ost.compression = CompressionNone
-		case CompressionGzip:
-			ost.compression = CompressionGzip
+		}
+		avcfg := &avroEncoderConfig{
+			compression: ost.compression,
+			blockLength: 1000,
+			timeKey:     ost.timeKey,
+			tagKey:      ost.tagKey,
+		}
+		if abl, ok := pluginConfigValueToInt(plugin, "AvroBlockLength"); ok {
+			avcfg.blockLength = int(abl)
+		}
+		if path := flbAPI.FLBPluginConfigKey(plugin, "AvroSchemaFile"); path != "" {
+			if schema, err := loadAvroSchema(path); err != nil {
+				logger.Warn().Err(err).Msgf("'AvroSchemaFile %s' could not be loaded; inferring the schema instead", path)
+			} else {
+				avcfg.schema = schema
+			}
+		}
+		ost.objectEncoder = avcfg
+	}
+
+	// parquet and avro compress inside the file, so the object as a whole is not compressed again
+	if ost.objectEncoder != nil {
+		ost.compression = CompressionNone
+	}
+
+	if retries, ok := pluginConfigValueToInt(plugin, "CommitRetries"); ok {
+		ost.commitRetries = int(retries)
+	}
+	if backoff, ok := pluginConfigValueToInt(plugin, "RetryBackoffSeconds"); ok {
+		ost.retryBackoffSeconds = int(backoff)
+	}
+	ost.retryBufferKiB = 2 * ost.bufferSizeKiB
+	if rbkb, ok := pluginConfigValueToInt(plugin, "RetryBufferKiB"); ok {
+		ost.retryBufferKiB = rbkb
+	}
+	ost.storageClass = flbAPI.FLBPluginConfigKey(plugin, "StorageClass")
+	ost.cacheControl = flbAPI.FLBPluginConfigKey(plugin, "CacheControl")
+	if spec := flbAPI.FLBPluginConfigKey(plugin, "Metadata"); spec != "" {
+		if metadata, err := parseMetadata(spec); err != nil {
+			logger.Warn().Err(err).Msg("'Metadata' should be a list of key=value; ignoring it")
+		} else {
+			ost.metadata = metadata
+		}
+	}
+	if stats, ok := pluginConfigValueToBool(plugin, "MetadataRecordStats"); ok {
+		ost.metadataRecordStats = stats
+	}
+
+	// objects that must be encrypted can't fall back to the default, so a bad key stops the plugin
+	ost.kmsKeyName = flbAPI.FLBPluginConfigKey(plugin, "KmsKeyName")
+	if keyFile := flbAPI.FLBPluginConfigKey(plugin, "EncryptionKeyFile"); keyFile != "" {
+		if ost.kmsKeyName != "" {
+			flbAPI.FLBPluginUnregister(plugin)
+			logger.Fatal().Msg("FLBPluginInit() KmsKeyName and EncryptionKeyFile can't both be set")
+			return output.FLB_ERROR
+		}
+		key, err := envelope.ReadKeyFile(keyFile)
+		if err != nil {
+			flbAPI.FLBPluginUnregister(plugin)
+			logger.Fatal().Msgf("FLBPluginInit() ReadKeyFile() %s", err.Error())
+			return output.FLB_ERROR
+		}
+		ost.encryptionKey = key
+	}
+	if ost.backend == BackendLocal && (ost.kmsKeyName != "" || ost.encryptionKey != nil) {
+		logger.Warn().Msg("the local backend does not encrypt files; KmsKeyName and EncryptionKeyFile are ignored")
+	}
+	if encrypt, ok := pluginConfigValueToBool(plugin, "Encrypt"); ok && encrypt {
+		key, err := envelope.ReadKeyFile(flbAPI.FLBPluginConfigKey(plugin, "EncryptKeyFile"))
+		if err != nil {
+			flbAPI.FLBPluginUnregister(plugin)
+			logger.Fatal().Msgf("FLBPluginInit() Encrypt needs EncryptKeyFile: %s", err.Error())
+			return output.FLB_ERROR
+		}
+		ost.encryptKey = key
+	} else if flbAPI.FLBPluginConfigKey(plugin, "EncryptKeyFile") != "" {
+		logger.Warn().Msg("EncryptKeyFile is set, but Encrypt is not on; objects are not encrypted before upload")
+	}
+
+	if keys := flbAPI.FLBPluginConfigKey(plugin, "PartitionKeys"); keys != "" {
+		ost.partitionKeys = parseColumnList(keys)
+		if !strings.Contains(ost.objectNameTemplate, ".Partition") {
+			logger.Warn().Str("template", ost.objectNameTemplate).Msg("PartitionKeys is set, but ObjectNameTemplate does not use .Partition")
+		}
+	}
+
+	if bucketTemplate != "" {
+		tpl, err := parseBucketTemplate(bucketTemplate)
+		if err != nil {
+			flbAPI.FLBPluginUnregister(plugin)
+			logger.Fatal().Msgf("FLBPluginInit() BucketTemplate %s", err.Error())
+			return output.FLB_ERROR
+		}
+		ost.bucketTemplate = tpl
+	}
+
+	ost.deadLetterDir = flbAPI.FLBPluginConfigKey(plugin, "DeadLetterDir")
+	ost.shutdownTimeoutSeconds = 30
+	if sts, ok := pluginConfigValueToInt(plugin, "ShutdownTimeoutSeconds"); ok {
+		ost.shutdownTimeoutSeconds = int(sts)
+	}
+	retries := NewRetryPolicy(ost.commitRetries, ost.retryBackoffSeconds)
+	retries.outputID = outputID
+
+	// with a spool, objects are written to local files first and uploaded when they're committed. Failed uploads
+	// are retried from the spool file; without one, from a copy kept in memory
+	if spoolDir := flbAPI.FLBPluginConfigKey(plugin, "SpoolDir"); spoolDir != "" {
+		ost.spoolDir = spoolDir
+		spc, err := NewSpoolClient(filepath.Join(spoolDir, outputID), client, retries, ost.deadLetterDir)
+		if err != nil {
+			flbAPI.FLBPluginUnregister(plugin)
+			logger.Fatal().Msgf("FLBPluginInit() NewSpoolClient() %s", err.Error())
+			return output.FLB_ERROR
+		}
+		if ost.objectEncoder != nil {
+			// these formats can only be written out whole, so only committed objects reach the spool
+			logger.Warn().Str("format", string(ost.format)).Msg("records are held in memory until their object is committed; the spool only keeps committed objects through a crash")
+		}
+		spc.SetEncryptionKey(ost.encryptionKey)
+		if err := spc.Recover(); err != nil {
+			logger.Error().Err(err).Str("spool", spc.dir).Msg("spool files from a previous run could not be recovered")
+		}
+		ost.gcsClient = spc
+	} else {
+		ost.gcsClient = NewRetryClient(client, retries, ost.retryBufferKiB*1024, ost.deadLetterDir)
+	}
+
+	// metrics are nice to have, so a listener that can't start doesn't stop the output
+	if addr := flbAPI.FLBPluginConfigKey(plugin, "MetricsAddress"); addr != "" {
+		ost.metricsAddress = addr
+		if err := startMetricsServer(addr); err != nil {
+			logger.Error().Str("MetricsAddress", addr).Err(err).Msg("metrics listener could not be started")
+		}
+	}
+
+	// like the metrics listener, there is one exporter per process, and it can't stop the output
+	if exporter := flbAPI.FLBPluginConfigKey(plugin, "OtelExporter"); exporter != "" {
+		switch TelemetryExporter(exporter) {
+		case ExporterNone, ExporterOTLP:
+			ost.otelExporter = TelemetryExporter(exporter)
 		default:
-			logger.Warn().Msgf("'Compression %s' should be 'gzip' or 'none'; using default", cmpr)
+			logger.Warn().Msgf("'OtelExporter %s' should be 'none' or 'otlp'; using default", exporter)
+		}
+	}
+	ost.otelEndpoint = flbAPI.FLBPluginConfigKey(plugin, "OtelEndpoint")
+	if ost.otelExporter == ExporterOTLP {
+		if err := startTelemetry(context.Background(), ost.otelEndpoint); err != nil {
+			logger.Error().Err(err).Msg("telemetry exporter could not be started")
 		}
 	}
 
-	instances[ost.outputID] = &ost
+	if err := registerInstance(ost); err != nil {
+		flbAPI.FLBPluginUnregister(plugin)
+		logger.Fatal().Msgf("FLBPluginInit() %s", err.Error())
+		return output.FLB_ERROR
+	}
 
-	flbAPI.FLBPluginSetContext(plugin, ost)
+	flbAPI.FLBPluginSetContext(plugin, ost.outputID)
 
 	return output.FLB_OK
 }
@@ -200,8 +808,13 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 //export FLBPluginFlushCtx
 func FLBPluginFlushCtx(plugin, data unsafe.Pointer, length C.int, tag *C.char) int {
 	//notest
-	state := flbAPI.FLBPluginGetContext(plugin).(outputState)
-	return flbPluginFlushCtxGo(&state, data, int(length), C.GoString(tag))
+	outputID := flbAPI.FLBPluginGetContext(plugin).(string)
+	state := lookupInstance(outputID)
+	if state == nil {
+		logger.Error().Str("outputID", outputID).Msg("flush of an output instance that was never initialized")
+		return output.FLB_ERROR
+	}
+	return flbPluginFlushCtxGo(state, data, int(length), C.GoString(tag))
 }
 
 // logs are emitted as 2-arrays of [timestamp, fields{}]
@@ -210,23 +823,239 @@ type logRec []interface{}
 // fields in a log record have string keys and values are mostly strings but may be something else
 type logFields map[string]interface{}
 
-// flbPluginFlushCtxGo higher-level flush implementation accepting parameters which are mostly gotypes instead of Ctypes
-func flbPluginFlushCtxGo(state *outputState, data unsafe.Pointer, length int, tagName string) int {
-	work, exists := state.workers[tagName]
+// workerKey the key of the worker for a tag and partition in bucket
+func (state *outputState) workerKey(bucket, tagName string, partition map[string]string) string {
+	key := partitionWorkerKey(tagName, state.partitionKeys, partition)
+	if state.bucketTemplate != nil {
+		// no bucket has a NUL in it either
+		key = bucket + "\x00" + key
+	}
+	return key
+}
+
+// pinWorker the worker with key, for a tag and partition in bucket, created when it's first needed, which isn't
+// evicted until it's unpinned
+//
+// Each call is a use of the worker. The workers not used for workerIdleSeconds,
+// and the least recently used beyond maxWorkers, are evicted: closed (which
+// commits their objects) and forgotten, so that a new tag after another doesn't
+// grow the workers map forever. A flush pins the workers it writes to, so
+// that they aren't evicted until it's done with them.
+func (state *outputState) pinWorker(key, bucket, tagName string, partition map[string]string) *ObjectWorker {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	work, exists := state.workers[key]
 	if !exists {
-		work = NewObjectWorker(
-			tagName,
-			state.bucket,
-			state.objectNameTemplate,
-			state.bufferSizeKiB,
-			state.bufferTimeoutSeconds,
-			state.compression,
-		)
-		state.workers[tagName] = work
+		work = state.newWorker(bucket, tagName, partition)
+		state.workers[key] = work
+	}
+	if state.lru == nil {
+		state.lru = newWorkerLRU()
 	}
+	if state.pins == nil {
+		state.pins = map[string]int{}
+	}
+	state.lru.touch(key, state.now())
+	state.pins[key]++
+	return work
+}
+
+// unpinWorkers release the workers with keys pinned by pinWorker, and evict the workers that are due to be
+func (state *outputState) unpinWorkers(keys []string) {
+	state.mutex.Lock()
+	for _, key := range keys {
+		if state.pins[key]--; state.pins[key] <= 0 {
+			delete(state.pins, key)
+		}
+	}
+	evicted := state.evictWorkers(state.now())
+	state.mutex.Unlock()
 
+	// a commit can take a while, so the other threads can go on using their workers meanwhile
+	for _, old := range evicted {
+		metrics.workersEvicted.WithLabelValues(state.outputID, old.tag).Inc()
+		if err := old.Close(); err != nil {
+			logger.Error().Str("tag", old.tag).Err(err).Msg("evicted worker could not commit its object")
+		}
+	}
+	if len(evicted) == 0 {
+		return
+	}
+
+	// the metrics of a tag are forgotten with its last worker; a new worker is only made under the mutex
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	for _, old := range evicted {
+		if !state.hasTagWorker(old.tag) {
+			metrics.forgetWorkers(state.outputID, old.tag)
+		}
+	}
+}
+
+// hasTagWorker true when a worker of the tag is left, in any partition or bucket. The caller holds the mutex
+func (state *outputState) hasTagWorker(tagName string) bool {
+	for _, work := range state.workers {
+		if work.tag == tagName {
+			return true
+		}
+	}
+	return false
+}
+
+// evictWorkers forget the workers idle for workerIdleSeconds at now, and the least recently used beyond
+// maxWorkers, and return them to be closed. A pinned worker is passed over, and evicted once it's unpinned, if it's
+// still due to be. The caller holds the mutex
+func (state *outputState) evictWorkers(now time.Time) []*ObjectWorker {
+	if state.lru == nil {
+		return nil
+	}
+	idle := time.Duration(state.workerIdleSeconds) * time.Second
+	var evicted []*ObjectWorker
+	state.lru.walk(func(key string, used time.Time) bool {
+		tooMany := state.maxWorkers > 0 && state.lru.len() > state.maxWorkers
+		tooIdle := state.workerIdleSeconds > 0 && now.Sub(used) >= idle
+		if !tooMany && !tooIdle {
+			return false
+		}
+		if state.pins[key] > 0 {
+			return true
+		}
+		logger.Debug().Str("outputID", state.outputID).Str("worker", key).Bool("idle", tooIdle).Msg("evicting worker")
+		evicted = append(evicted, state.workers[key])
+		delete(state.workers, key)
+		state.lru.remove(key)
+		return true
+	})
+	return evicted
+}
+
+// now the time of the instance's clock
+func (state *outputState) now() time.Time {
+	if state.clock == nil {
+		return time.Now()
+	}
+	return state.clock.Now()
+}
+
+// newWorker make the worker for a tag and partition in bucket
+func (state *outputState) newWorker(bucket, tagName string, partition map[string]string) *ObjectWorker {
+	work := NewObjectWorker(
+		tagName,
+		bucket,
+		state.objectNameTemplate,
+		state.bufferSizeKiB,
+		state.bufferTimeoutSeconds,
+		state.compression,
+	)
+	work.compressionLevel = state.compressionLevel
+	work.encoderFactory = state.objectEncoder
+	work.partition = partition
+	work.idleTimeoutMicro = int64(state.idleTimeoutSeconds) * 1_000_000
+	work.maxRecords = state.maxRecords
+	work.rotate = state.rotateOnBoundary
+	work.location = state.rotateTimeZone
+	work.attrs = objectAttrs{
+		ContentType:  formatContentType(state.format),
+		StorageClass: state.storageClass,
+		CacheControl: state.cacheControl,
+		Metadata:     objectAttrs{Metadata: defaultMetadata()}.withMetadata(state.metadata).Metadata,
+
+		KMSKeyName:    state.kmsKeyName,
+		EncryptionKey: state.encryptionKey,
+	}
+	work.recordStats = state.metadataRecordStats
+	work.encryptKey = state.encryptKey
+	work.flushPuts = state.spoolDir != ""
+	work.metrics = metrics.forWorker(state.outputID, tagName)
+	work.metrics.opened()
+	if hdr, ok := state.encoder.(IHeaderEncoder); ok {
+		work.header = hdr.Header()
+	}
+	return work
+}
+
+// flushBatch the records of a flush that go to one worker: encoded into buf, or kept as they are for a format
+// that buffers its objects
+type flushBatch struct {
+	key       string
+	bucket    string
+	partition map[string]string
+	work      *ObjectWorker
+
+	buf     bytes.Buffer
+	span    recordSpan
+	records []flushRecord
+}
+
+// flushRecord one record of a flush, for a format that buffers its objects
+type flushRecord struct {
+	timestamp float64
+	fields    logFields
+}
+
+// count the records of the batch
+func (batch *flushBatch) count() int {
+	if batch.records != nil {
+		return len(batch.records)
+	}
+	return int(batch.span.count)
+}
+
+// put write the batch to its worker, and return the records written; the rest are lost when it fails
+func (batch *flushBatch) put(ctx context.Context, state *outputState, tagName string) (int, error) {
+	if batch.records != nil {
+		for i, rec := range batch.records {
+			if err := batch.work.PutRecord(ctx, state.gcsClient, tagName, rec.timestamp, rec.fields); err != nil {
+				return i, err
+			}
+		}
+		return len(batch.records), nil
+	}
+	if batch.buf.Len() == 0 {
+		return 0, nil
+	}
+	if err := batch.work.PutRecords(ctx, state.gcsClient, batch.buf, batch.span); err != nil {
+		return 0, err
+	}
+	return batch.count(), nil
+}
+
+// flbPluginFlushCtxGo higher-level flush implementation accepting parameters which are mostly gotypes instead of Ctypes
+//
+// The records are sorted into a batch per worker before any is written, so a
+// chunk is only retried when none of it was written. When some batches fail
+// after others were written, retrying the chunk would write the others again,
+// so the chunk is dropped instead (FLB_ERROR), losing the records of the failed
+// batches.
+func flbPluginFlushCtxGo(state *outputState, data unsafe.Pointer, length int, tagName string) int {
 	dec := flbAPI.NewDecoder(data, length)
-	buf := new(bytes.Buffer)
+	records := 0
+	ctx, span := tracer.Start(context.Background(), "flbPluginFlushCtxGo",
+		trace.WithAttributes(attrOutputID.String(state.outputID), attrTag.String(tagName), attrBytes.Int(length)))
+	defer func() {
+		metrics.received(state.outputID, tagName, records, length)
+		span.SetAttributes(attrRecords.Int(records))
+		span.End()
+	}()
+
+	// fluent-bit sends the whole chunk again later
+	retry := func(err error) int {
+		metrics.flushRetries.WithLabelValues(state.outputID, tagName).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return output.FLB_RETRY
+	}
+
+	// while too much is waiting to be uploaded, and committing the open objects doesn't make room, fluent-bit keeps
+	// the chunk (in its own storage) and sends it again
+	if !inFlight.wait(time.Duration(state.inFlightWaitSeconds)*time.Second) && !makeInFlightRoom(state) {
+		logger.Warn().Str("outputID", state.outputID).Str("tag", tagName).Int64("held", inFlight.heldBytes()).Msg("MaxInFlightBytes are waiting to be uploaded; retrying the flush")
+		return retry(errInFlightExhausted)
+	}
+
+	// records go to the worker of their bucket and partition; each worker gets its encoded records in one Put
+	var batches []*flushBatch
+	byKey := map[string]*flushBatch{}
 
 	// Gets called with a batch of records to be written to an instance.
 	// Decode each rec
@@ -235,11 +1064,9 @@ func flbPluginFlushCtxGo(state *outputState, data unsafe.Pointer, length int, ta
 		if rc != 0 {
 			break
 		}
-		buf.WriteString(fmt.Sprintf("%s: ", tagName))
-
-		timestamp := float64((ts.(output.FLBTime)).UnixMicro())
+		records++
+		timestamp := float64((ts.(output.FLBTime)).UnixMicro()) / 1e6
 		fields := logFields{}
-		go_rec := logRec{timestamp / 1e6, fields}
 
 		for key, val := range rec {
 			key := key.(string)
@@ -251,16 +1078,67 @@ func flbPluginFlushCtxGo(state *outputState, data unsafe.Pointer, length int, ta
 				fields[key] = val
 			}
 		}
-		marshalled, _ := json.Marshal(go_rec)
-		buf.Write(marshalled)
-		buf.WriteString("\n")
+
+		partition := partitionValues(state.partitionKeys, fields)
+		bucket, err := state.recordBucket(ctx, tagName, partition, fields)
+		if err != nil {
+			logger.Error().Str("tag", tagName).Err(err).Msg("record has no bucket, dropping it")
+			continue
+		}
+		key := state.workerKey(bucket, tagName, partition)
+		batch, ok := byKey[key]
+		if !ok {
+			batch = &flushBatch{key: key, bucket: bucket, partition: partition}
+			byKey[key] = batch
+			batches = append(batches, batch)
+		}
+
+		if state.objectEncoder != nil {
+			batch.records = append(batch.records, flushRecord{timestamp: timestamp, fields: fields})
+			continue
+		}
+
+		if err := state.encoder.EncodeRecord(&batch.buf, tagName, timestamp, fields); err != nil {
+			logger.Warn().Str("tag", tagName).Err(err).Msg("record could not be encoded, dropping it")
+			continue
+		}
+		batch.span.add(recordSpan{count: 1, first: timestamp, last: timestamp})
 	}
 
-	if err := work.Put(state.gcsClient, *buf); err != nil {
-		return output.FLB_RETRY
+	// the workers are evicted (when they're due to be) only once every batch was written
+	keys := make([]string, len(batches))
+	for i, batch := range batches {
+		batch.work = state.pinWorker(batch.key, batch.bucket, tagName, batch.partition)
+		keys[i] = batch.key
 	}
+	defer state.unpinWorkers(keys)
+
+	var errs []error
+	written, lost := 0, 0
+	for _, batch := range batches {
+		n, err := batch.put(ctx, state, tagName)
+		written += n
+		if err != nil {
+			errs = append(errs, err)
+			lost += batch.count() - n
+		}
 
-	logger.Debug().Str("object", work.FormatBucketPath()).Int64("written-bytes", work.Written).Send()
+		if logger.Debug().Enabled() {
+			status := batch.work.Status()
+			logger.Debug().Str("object", status.Object).Int64("written-bytes", status.Written).Send()
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		if written == 0 {
+			return retry(err)
+		}
+		logger.Error().Str("outputID", state.outputID).Str("tag", tagName).Int("written", written).Int("lost", lost).Err(err).
+			Msg("part of the chunk could not be written; dropping the rest, since retrying it would write the records already written again")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return output.FLB_ERROR
+	}
 
 	return output.FLB_OK
 }
@@ -276,23 +1154,23 @@ func flbPluginFlushCtxGo(state *outputState, data unsafe.Pointer, length int, ta
 // 	return output.FLB_OK
 // }
 
-// FLBPluginExit visit every worker and call Close to commit the open objects.
+// FLBPluginExit shut down every instance: commit the open objects, and wait for their uploads.
+//
+// At exit, due to the bug above, we shut down every instance we have
+// initialized, all at once, each within its ShutdownTimeoutSeconds. The
+// workers of an instance are closed in parallel; closing a worker waits for a
+// commit its timer may have started. An instance is only shut down once,
+// however many times this is called.
 //
-// At exit, due to the bug above, we visit every worker we have initialized and
-// call Close to make sure the objects get committed. The nil check is the only
-// way we can be sure not to close one twice
 //export FLBPluginExit
 func FLBPluginExit() int {
-	for _, inst := range instances {
-		logger.Debug().Str("outputID", inst.outputID).Msgf("cleaning up instance %s", inst.outputID)
-		for _, worker := range inst.workers {
-			// due to the FLBPluginExitCtx bug (see comment above), we just have
-			// to check and see whether each one is closed here.
-			if worker.Writer != nil {
-				worker.Commit()
-			}
-		}
-	}
+	instancesMutex.Lock()
+	insts := maps.Clone(instances)
+	instancesMutex.Unlock()
+
+	shutdownInstances(insts)
+	stopMetricsServer()
+	stopTelemetry()
 	return output.FLB_OK
 }
 
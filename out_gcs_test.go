@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/output"
 )
 
 type opcConfig map[string]string
@@ -78,6 +87,31 @@ func Test_pluginConfigValueToInt(t *testing.T) {
 	}
 }
 
+// Test_pluginConfigValueToBool do we convert the usual spellings of true and false (or fallback to default)?
+func Test_pluginConfigValueToBool(t *testing.T) {
+	plugin := unsafe.Pointer(&outputPluginForTest{})
+	tests := []struct {
+		sval   string
+		want   bool
+		wantOk bool
+	}{
+		{sval: "true", want: true, wantOk: true},
+		{sval: "On", want: true, wantOk: true},
+		{sval: "no", want: false, wantOk: true},
+		{sval: "0", want: false, wantOk: true},
+		{sval: "", want: false, wantOk: false},
+		{sval: "maybe", want: false, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sval, func(t *testing.T) {
+			flbAPI = &flbOutputAPIForTest{config: opcConfig{"some_key": tt.sval}}
+			if got, ok := pluginConfigValueToBool(plugin, "some_key"); got != tt.want || ok != tt.wantOk {
+				t.Errorf("pluginConfigValueToBool(%q) = %v, %v", tt.sval, got, ok)
+			}
+		})
+	}
+}
+
 // Test_FLBPluginInit_Exit do we convert the text config into a working
 // configured outputState; can we also do that twice, and then clean up and shut
 // down both?
@@ -105,16 +139,28 @@ func Test_FLBPluginInit_Exit(t *testing.T) {
 	FLBPluginInit(plugin1)
 
 	// make assertions about the config conversion that must have occurred
-	outConfig1 := flbAPI.FLBPluginGetContext(plugin1).(outputState)
-	expected := outputState{
-		bucket:               "bucketymcbucketface.example.com",
-		bufferSizeKiB:        19,
-		bufferTimeoutSeconds: 300,
-		compression:          CompressionNone,
-		gcsClient:            outConfig1.gcsClient,
-		outputID:             "1",
-		objectNameTemplate:   "{{ .InputTag }}-{{ .Timestamp }}",
-		workers:              map[string]*ObjectWorker{},
+	outConfig1 := stateForTest(plugin1)
+	expected := &outputState{
+		backend:                BackendGCS,
+		bucket:                 "bucketymcbucketface.example.com",
+		bufferSizeKiB:          19,
+		bufferTimeoutSeconds:   300,
+		commitRetries:          5,
+		compression:            CompressionNone,
+		encoder:                &legacyEncoder{},
+		format:                 FormatLegacy,
+		gcsClient:              outConfig1.gcsClient,
+		otelExporter:           ExporterNone,
+		outputID:               "1",
+		objectNameTemplate:     "{{ .InputTag }}-{{ .Timestamp }}",
+		retryBufferKiB:         38,
+		retryBackoffSeconds:    1,
+		rotateOnBoundary:       RotateNone,
+		shutdownTimeoutSeconds: 30,
+		tagKey:                 "tag",
+		timeKey:                "timestamp",
+		workerIdleSeconds:      600,
+		workers:                map[string]*ObjectWorker{},
 	}
 	if !reflect.DeepEqual(outConfig1, expected) {
 		t.Errorf("outConfig = %#v did not match expected %#v", outConfig1, expected)
@@ -144,7 +190,7 @@ func Test_FLBPluginInit_Exit(t *testing.T) {
 
 	// let's also beginStreaming on both instances so we have something to clean up
 	ctx := context.Background()
-	cli, _ := storageAPI.NewClient(ctx)
+	cli, _ := storageAPI.NewClient(ctx, storageConfig{})
 
 	work1 := NewObjectWorker(
 		"1",
@@ -155,7 +201,7 @@ func Test_FLBPluginInit_Exit(t *testing.T) {
 		CompressionNone,
 	)
 	outConfig1.workers["1"] = work1
-	work1.beginStreaming(cli)
+	work1.beginStreaming(context.Background(), cli)
 
 	work2 := NewObjectWorker(
 		"2",
@@ -165,9 +211,9 @@ func Test_FLBPluginInit_Exit(t *testing.T) {
 		19,
 		CompressionNone,
 	)
-	outConfig2 := flbAPI.FLBPluginGetContext(plugin2).(outputState)
+	outConfig2 := stateForTest(plugin2)
 	outConfig2.workers["2"] = work2
-	work2.beginStreaming(cli)
+	work2.beginStreaming(context.Background(), cli)
 
 	// now start cleaning these up
 	FLBPluginExit()
@@ -191,12 +237,14 @@ func Test_flbPluginFlushCtxGo(t *testing.T) {
 	// to gcp during this test.
 	storageAPI = &storageAPIForTest{}
 
-	gcsClient, _ := storageAPI.NewClient(context.Background())
+	gcsClient, _ := storageAPI.NewClient(context.Background(), storageConfig{})
 	state := outputState{
 		bucket:               "bucketymcbucketface.example.com",
 		bufferSizeKiB:        19,
 		bufferTimeoutSeconds: 300,
 		compression:          CompressionNone,
+		encoder:              &legacyEncoder{},
+		format:               FormatLegacy,
 		gcsClient:            gcsClient,
 		outputID:             "1",
 		objectNameTemplate:   "{{ .InputTag }}-{{ .Timestamp }}",
@@ -218,3 +266,435 @@ func Test_flbPluginFlushCtxGo(t *testing.T) {
 		t.Errorf("wanted: `%s` (x2)  got: %#v", want, got)
 	}
 }
+
+// Test_flbPluginFlushCtxGo_jsonLines do we write plain NDJSON records when Format json_lines is chosen?
+func Test_flbPluginFlushCtxGo_jsonLines(t *testing.T) {
+	storageAPI = &storageAPIForTest{}
+
+	gcsClient, _ := storageAPI.NewClient(context.Background(), storageConfig{})
+	state := outputState{
+		bucket:               "bucketymcbucketface.example.com",
+		bufferSizeKiB:        19,
+		bufferTimeoutSeconds: 300,
+		compression:          CompressionNone,
+		encoder:              NewRecordEncoder(FormatJSONLines, "ts", "tag"),
+		format:               FormatJSONLines,
+		gcsClient:            gcsClient,
+		outputID:             "1",
+		objectNameTemplate:   "{{ .InputTag }}-{{ .Timestamp }}",
+		tagKey:               "tag",
+		timeKey:              "ts",
+		workers:              map[string]*ObjectWorker{},
+	}
+
+	cbytePtr := goBytesToCBytes(memRecordForTest)
+
+	flbPluginFlushCtxGo(&state, cbytePtr, len(memRecordForTest), "my-tag")
+
+	wri := state.workers["my-tag"].Writer.(*storageWriterForTest)
+	got := wri.buf.String()
+
+	want := `(?m)^\{"Mem.free":\d+,.*"tag":"my-tag","ts":\d{10}\.\d{1,6}\}$`
+	rx := regexp.MustCompile(want)
+	if matches := rx.FindAllString(got, -1); len(matches) != 2 {
+		t.Errorf("wanted: `%s` (x2)  got: %#v", want, got)
+	}
+}
+
+// Test_flbPluginFlushCtxGo_partition does each partition of the records stream to its own object, named by
+// its partition values?
+func Test_flbPluginFlushCtxGo_partition(t *testing.T) {
+	cli := &storageClientForTest{}
+	state := outputState{
+		bucket:               "bucketymcbucketface.example.com",
+		bufferSizeKiB:        19,
+		bufferTimeoutSeconds: 300,
+		compression:          CompressionNone,
+		encoder:              NewRecordEncoder(FormatJSONLines, "ts", "tag"),
+		format:               FormatJSONLines,
+		gcsClient:            cli,
+		outputID:             "1",
+		objectNameTemplate:   `{{ .InputTag }}/used={{ index .Partition "Mem.used" }}/service={{ .Partition.service }}/x`,
+		partitionKeys:        []string{"Mem.used", "service"},
+		tagKey:               "tag",
+		timeKey:              "ts",
+		workers:              map[string]*ObjectWorker{},
+	}
+
+	cbytePtr := goBytesToCBytes(memRecordForTest)
+
+	flbPluginFlushCtxGo(&state, cbytePtr, len(memRecordForTest), "my-tag")
+
+	if len(state.workers) != 2 {
+		t.Fatalf("wanted 2 workers, one per partition, got %d", len(state.workers))
+	}
+	for _, work := range state.workers {
+		work.Close()
+	}
+
+	for _, used := range []string{"5124272", "5124296"} {
+		path := "bucketymcbucketface.example.com/my-tag/used=" + used + "/service=__HIVE_DEFAULT_PARTITION__/x"
+		wri, ok := cli.objects[path]
+		if !ok {
+			t.Errorf("no object %s in %v", path, cli.objects)
+			continue
+		}
+		if lines := strings.Count(wri.buf.String(), "\n"); lines != 1 || !strings.Contains(wri.buf.String(), `"Mem.used":`+used) {
+			t.Errorf("%s has the wrong records: %s", path, wri.buf.String())
+		}
+	}
+}
+
+// Test_flbPluginFlushCtxGo_partitionFails is a chunk only retried when none of it was written, and otherwise dropped,
+// so that the partitions that were written aren't written again?
+func Test_flbPluginFlushCtxGo_partitionFails(t *testing.T) {
+	cli := &storageClientForTest{failWrites: map[string]bool{"b/my-tag/service=db/x": true}}
+	state := &outputState{
+		bucket:               "b",
+		bufferSizeKiB:        19,
+		bufferTimeoutSeconds: 300,
+		compression:          CompressionNone,
+		encoder:              &legacyEncoder{},
+		gcsClient:            cli,
+		outputID:             "partition-fails",
+		objectNameTemplate:   "{{ .InputTag }}/service={{ .Partition.service }}/x",
+		partitionKeys:        []string{"service"},
+		workers:              map[string]*ObjectWorker{},
+	}
+
+	chunk := chunkForTest(map[string]string{"service": "api"}, map[string]string{"service": "db"}, map[string]string{"service": "web"})
+	if rc := flbPluginFlushCtxGo(state, goBytesToCBytes(chunk), len(chunk), "my-tag"); rc != output.FLB_ERROR {
+		t.Errorf("a chunk with one failed partition returned %d, wanted FLB_ERROR", rc)
+	}
+	chunk = chunkForTest(map[string]string{"service": "db"})
+	if rc := flbPluginFlushCtxGo(state, goBytesToCBytes(chunk), len(chunk), "my-tag"); rc != output.FLB_RETRY {
+		t.Errorf("a chunk that was not written at all returned %d, wanted FLB_RETRY", rc)
+	}
+
+	for _, work := range state.workers {
+		work.Close()
+	}
+	for _, service := range []string{"api", "web"} {
+		wri := cli.objects["b/my-tag/service="+service+"/x"]
+		if wri == nil || strings.Count(wri.buf.String(), "service") != 1 {
+			t.Errorf("the %s partition was not written once: %#v", service, wri)
+		}
+	}
+}
+
+// Test_FLBPluginInit_encryption is the key in EncryptionKeyFile given to each object, along with KmsKeyName, and
+// the key in EncryptKeyFile to each worker?
+func Test_FLBPluginInit_encryption(t *testing.T) {
+	storageAPI = &storageAPIForTest{}
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))+"\n"), 0o600)
+
+	plugin := unsafe.Pointer(&outputPluginForTest{})
+	flbAPI = &flbOutputAPIForTest{config: opcConfig{
+		"Bucket":            "bucketymcbucketface.example.com",
+		"Encrypt":           "on",
+		"EncryptKeyFile":    keyFile,
+		"EncryptionKeyFile": keyFile,
+		"OutputID":          "csek",
+	}}
+
+	FLBPluginInit(plugin)
+	defer delete(instances, "csek")
+
+	state := stateForTest(plugin)
+	if !bytes.Equal(state.encryptionKey, bytes.Repeat([]byte{7}, 32)) {
+		t.Fatalf("encryption key %v", state.encryptionKey)
+	}
+
+	state.kmsKeyName = "projects/p/locations/l/keyRings/r/cryptoKeys/k"
+	work := state.worker("my-tag", nil)
+	defer work.Close()
+	if !bytes.Equal(work.attrs.EncryptionKey, state.encryptionKey) || work.attrs.KMSKeyName != state.kmsKeyName {
+		t.Errorf("worker attrs %#v", work.attrs)
+	}
+	if !bytes.Equal(work.encryptKey, state.encryptionKey) {
+		t.Errorf("worker key-encryption key %v", work.encryptKey)
+	}
+}
+
+// Test_FLBPluginInit_backend is the client made for the chosen backend and connection options, and an unknown
+// backend ignored?
+func Test_FLBPluginInit_backend(t *testing.T) {
+	tests := []struct {
+		backend string
+		want    StorageBackend
+	}{
+		{backend: "s3", want: BackendS3},
+		{backend: "dropbox", want: BackendGCS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			sapi := &storageAPIForTest{}
+			storageAPI = sapi
+
+			plugin := unsafe.Pointer(&outputPluginForTest{})
+			flbAPI = &flbOutputAPIForTest{config: opcConfig{
+				"Backend":                   tt.backend,
+				"Bucket":                    "bucketymcbucketface.example.com",
+				"CredentialsFile":           "/etc/sa.json",
+				"CredentialsJSON":           `{"type": "service_account"}`,
+				"Endpoint":                  "http://minio.local:9000",
+				"ImpersonateDelegates":      "a@p.iam.gserviceaccount.com, b@p.iam.gserviceaccount.com",
+				"ImpersonateServiceAccount": "writer@p.iam.gserviceaccount.com",
+				"NoAuth":                    "On",
+				"OutputID":                  "backend",
+				"ProjectID":                 "my-project",
+				"Region":                    "us-east-1",
+			}}
+
+			FLBPluginInit(plugin)
+			defer delete(instances, "backend")
+
+			want := storageConfig{
+				backend:         tt.want,
+				endpoint:        "http://minio.local:9000",
+				credentialsFile: "/etc/sa.json",
+				credentialsJSON: `{"type": "service_account"}`,
+				impersonate:     "writer@p.iam.gserviceaccount.com",
+				delegates:       []string{"a@p.iam.gserviceaccount.com", "b@p.iam.gserviceaccount.com"},
+				noAuth:          true,
+				projectID:       "my-project",
+				region:          "us-east-1",
+			}
+			if !reflect.DeepEqual(sapi.cfg, want) {
+				t.Errorf("wanted: %#v got: %#v", want, sapi.cfg)
+			}
+			if state := stateForTest(plugin); state.backend != tt.want {
+				t.Errorf("backend was %s", state.backend)
+			}
+		})
+	}
+}
+
+// Test_FLBPluginInit_parquet does Format parquet set up an object encoder that owns the compression?
+func Test_FLBPluginInit_parquet(t *testing.T) {
+	storageAPI = &storageAPIForTest{}
+
+	plugin := unsafe.Pointer(&outputPluginForTest{})
+	flbAPI = &flbOutputAPIForTest{config: opcConfig{
+		"Bucket":              "bucketymcbucketface.example.com",
+		"Compression":         "gzip",
+		"Format":              "parquet",
+		"OutputID":            "pq",
+		"ParquetRowGroupSize": "500",
+		"ParquetSchema":       "level:string,status:int64",
+		"TimeKey":             "@t",
+	}}
+
+	FLBPluginInit(plugin)
+	defer delete(instances, "pq")
+
+	state := stateForTest(plugin)
+	if state.compression != CompressionNone {
+		t.Errorf("whole-object compression should be none for parquet, was %s", state.compression)
+	}
+
+	want := &parquetEncoderConfig{
+		columns:      []recordColumn{{"level", columnString}, {"status", columnInt64}},
+		compression:  CompressionGzip,
+		rowGroupSize: 500,
+		timeKey:      "@t",
+		tagKey:       "tag",
+	}
+	if !reflect.DeepEqual(state.objectEncoder, want) {
+		t.Errorf("wanted: %#v got: %#v", want, state.objectEncoder)
+	}
+}
+
+// Test_FLBPluginInit_csv does Format tsv set up a csv encoder with its column list and policies?
+func Test_FLBPluginInit_csv(t *testing.T) {
+	storageAPI = &storageAPIForTest{}
+
+	plugin := unsafe.Pointer(&outputPluginForTest{})
+	flbAPI = &flbOutputAPIForTest{config: opcConfig{
+		"Bucket":            "bucketymcbucketface.example.com",
+		"Columns":           "timestamp, level ,msg",
+		"Compression":       "snappy",
+		"CsvExtraKeys":      "collect",
+		"CsvMissingColumns": "sometimes",
+		"Format":            "tsv",
+		"OutputID":          "csv",
+		"PartitionKeys":     "level, service",
+	}}
+
+	FLBPluginInit(plugin)
+	defer delete(instances, "csv")
+
+	state := stateForTest(plugin)
+	if state.compression != CompressionSnappy {
+		t.Errorf("compression should be snappy, was %s", state.compression)
+	}
+	if !reflect.DeepEqual(state.partitionKeys, []string{"level", "service"}) {
+		t.Errorf("partitionKeys were %#v", state.partitionKeys)
+	}
+
+	want := &csvEncoder{
+		columns: []string{"timestamp", "level", "msg"},
+		comma:   '\t',
+		extra:   CsvExtraKeysCollect,
+		missing: CsvMissingEmpty,
+		timeKey: "timestamp",
+		tagKey:  "tag",
+	}
+	if !reflect.DeepEqual(state.encoder, want) {
+		t.Errorf("wanted: %#v got: %#v", want, state.encoder)
+	}
+}
+
+// Test_FLBPluginInit_rotation are MaxRecords, RotateOnBoundary and RotateTimeZone given to each worker, and an unknown
+// time zone replaced by UTC?
+func Test_FLBPluginInit_rotation(t *testing.T) {
+	tests := []struct {
+		zone string
+		want string
+	}{
+		{zone: "America/Chicago", want: "America/Chicago"},
+		{zone: "Mars/Olympus_Mons", want: "UTC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.zone, func(t *testing.T) {
+			storageAPI = &storageAPIForTest{}
+
+			plugin := unsafe.Pointer(&outputPluginForTest{})
+			flbAPI = &flbOutputAPIForTest{config: opcConfig{
+				"Bucket":           "bucketymcbucketface.example.com",
+				"MaxRecords":       "1000",
+				"OutputID":         "rotation",
+				"RotateOnBoundary": "hour",
+				"RotateTimeZone":   tt.zone,
+			}}
+
+			FLBPluginInit(plugin)
+			defer delete(instances, "rotation")
+
+			state := stateForTest(plugin)
+			work := state.worker("my-tag", nil)
+			defer work.Close()
+			if work.maxRecords != 1000 || work.rotate != RotateHour || work.location.String() != tt.want {
+				t.Errorf("worker maxRecords %d, rotate %s, location %s", work.maxRecords, work.rotate, work.location)
+			}
+		})
+	}
+}
+
+// Test_FLBPluginInit_bucketTemplate can an output have BucketTemplate instead of Bucket?
+func Test_FLBPluginInit_bucketTemplate(t *testing.T) {
+	storageAPI = &storageAPIForTest{}
+
+	plugin := unsafe.Pointer(&outputPluginForTest{})
+	flbAPI = &flbOutputAPIForTest{config: opcConfig{
+		"BucketTemplate": "logs-{{ .Record.tenant }}",
+		"OutputID":       "bucketTemplate",
+	}}
+
+	if rc := FLBPluginInit(plugin); rc != output.FLB_OK {
+		t.Fatalf("FLBPluginInit returned %d", rc)
+	}
+	defer delete(instances, "bucketTemplate")
+
+	state := stateForTest(plugin)
+	bucket, err := state.renderBucket("my-tag", nil, logFields{"tenant": "acme"})
+	if state.bucket != "" || bucket != "logs-acme" || err != nil {
+		t.Errorf("Bucket '%s', and a record of acme goes to '%s' (%v)", state.bucket, bucket, err)
+	}
+}
+
+// Test_FLBPluginInit_timeouts does MaxObjectAgeSeconds take the place of BufferTimeoutSeconds, and is
+// IdleTimeoutSeconds given to each worker?
+func Test_FLBPluginInit_timeouts(t *testing.T) {
+	storageAPI = &storageAPIForTest{}
+
+	plugin := unsafe.Pointer(&outputPluginForTest{})
+	flbAPI = &flbOutputAPIForTest{config: opcConfig{
+		"Bucket":               "bucketymcbucketface.example.com",
+		"BufferTimeoutSeconds": "300",
+		"IdleTimeoutSeconds":   "15",
+		"MaxObjectAgeSeconds":  "3600",
+		"OutputID":             "timeouts",
+	}}
+
+	FLBPluginInit(plugin)
+	defer delete(instances, "timeouts")
+
+	state := stateForTest(plugin)
+	work := state.worker("my-tag", nil)
+	defer work.Close()
+	if work.bufferTimeoutMicro != 3600_000_000 || work.idleTimeoutMicro != 15_000_000 {
+		t.Errorf("worker maximum age %dµs, idle timeout %dµs", work.bufferTimeoutMicro, work.idleTimeoutMicro)
+	}
+}
+
+// Test_registerInstance is each instance found by its OutputID, and a second instance with the same OutputID
+// refused?
+func Test_registerInstance(t *testing.T) {
+	state := &outputState{outputID: "registered"}
+	if err := registerInstance(state); err != nil {
+		t.Fatalf("registerInstance() %s", err)
+	}
+	defer delete(instances, "registered")
+
+	if got := lookupInstance("registered"); got != state {
+		t.Errorf("lookupInstance() = %p, wanted %p", got, state)
+	}
+	if err := registerInstance(&outputState{outputID: "registered"}); err == nil {
+		t.Error("a second instance with the same OutputID was registered")
+	}
+	if got := lookupInstance("unregistered"); got != nil {
+		t.Errorf("lookupInstance() of an unknown OutputID = %p", got)
+	}
+}
+
+// Test_flbPluginFlushCtxGo_concurrent are flushes of one instance from several threads at once, as with
+// fluent-bit's `workers`, safe? Is every record written once, to one worker per tag? Run with -race.
+func Test_flbPluginFlushCtxGo_concurrent(t *testing.T) {
+	storageAPI = &storageAPIForTest{}
+
+	plugin := unsafe.Pointer(&outputPluginForTest{})
+	flbAPI = &flbOutputAPIForTest{config: opcConfig{
+		"Bucket":             "bucketymcbucketface.example.com",
+		"Format":             "json_lines",
+		"ObjectNameTemplate": "{{ .InputTag }}/{{ .Uuid }}",
+		"OutputID":           "concurrent",
+	}}
+
+	FLBPluginInit(plugin)
+	defer delete(instances, "concurrent")
+	state := stateForTest(plugin)
+	cli := &storageClientForTest{}
+	state.gcsClient = cli
+
+	const threads, flushes = 8, 50
+	var wg sync.WaitGroup
+	for th := 0; th < threads; th++ {
+		wg.Add(1)
+		go func(th int) {
+			defer wg.Done()
+			tag := fmt.Sprintf("tag-%d", th%2)
+			for i := 0; i < flushes; i++ {
+				cbytePtr := goBytesToCBytes(memRecordForTest)
+				if rc := flbPluginFlushCtxGo(stateForTest(plugin), cbytePtr, len(memRecordForTest), tag); rc != output.FLB_OK {
+					t.Errorf("flush returned %d", rc)
+				}
+			}
+		}(th)
+	}
+	wg.Wait()
+
+	if len(state.workers) != 2 {
+		t.Errorf("%d workers for 2 tags", len(state.workers))
+	}
+	shutdownInstances(map[string]*outputState{"concurrent": state})
+
+	records := 0
+	for _, wri := range cli.objects {
+		records += strings.Count(wri.buf.String(), "\n")
+	}
+	if want := threads * flushes * 2; records != want {
+		t.Errorf("%d records were written to %d objects, wanted %d", records, len(cli.objects), want)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+// parseParquetSchema parse a ParquetSchema config value like "level:string,status:int64,latency:double"
+func parseParquetSchema(spec string) ([]recordColumn, error) {
+	var cols []recordColumn
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, typ, found := strings.Cut(part, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("column '%s' should be written as name:type", part)
+		}
+		switch ct := columnType(strings.TrimSpace(typ)); ct {
+		case columnString, columnInt64, columnDouble, columnBoolean:
+			cols = append(cols, recordColumn{name: name, typ: ct})
+		default:
+			return nil, fmt.Errorf("column '%s' has type '%s'; should be string, int64, double or boolean", name, typ)
+		}
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("no columns in '%s'", spec)
+	}
+	return cols, nil
+}
+
+// parquetEncoderConfig per-output settings for Format parquet; makes one parquetObjectEncoder per object
+type parquetEncoderConfig struct {
+	// declared columns; when nil, columns are inferred from the records in each object
+	columns []recordColumn
+
+	// parquet column compression codec
+	compression CompressionType
+
+	// maximum number of rows in each parquet row group
+	rowGroupSize int64
+
+	// names of the timestamp and tag columns, which every object gets
+	timeKey string
+	tagKey  string
+}
+
+func (cfg *parquetEncoderConfig) NewObjectEncoder() IObjectEncoder {
+	return &parquetObjectEncoder{config: cfg}
+}
+
+func (cfg *parquetEncoderConfig) FileExtension() string {
+	return ".parquet"
+}
+
+// codec the parquet page compression codec matching our Compression option
+func (cfg *parquetEncoderConfig) codec() compress.Codec {
+	switch cfg.compression {
+	case CompressionGzip:
+		return &parquet.Gzip
+	case CompressionZstd:
+		return &parquet.Zstd
+	case CompressionSnappy:
+		return &parquet.Snappy
+	case CompressionLz4:
+		return &parquet.Lz4Raw
+	default:
+		return &parquet.Uncompressed
+	}
+}
+
+// parquetObjectEncoder collects the records of one object and writes them out as a parquet file on commit
+type parquetObjectEncoder struct {
+	config  *parquetEncoderConfig
+	records []bufferedRecord
+	size    int64
+}
+
+func (enc *parquetObjectEncoder) AddRecord(tag string, timestamp float64, fields logFields) error {
+	enc.records = append(enc.records, bufferedRecord{tag: tag, timestamp: timestamp, fields: fields})
+	enc.size += bufferedRecordSize(tag, fields)
+	return nil
+}
+
+func (enc *parquetObjectEncoder) Size() int64 {
+	return enc.size
+}
+
+// WriteTo write all the collected records as a parquet file to w
+func (enc *parquetObjectEncoder) WriteTo(w io.Writer) (int64, error) {
+	columns := enc.config.columns
+	if columns == nil {
+		columns = inferColumns(enc.records, enc.config.timeKey, enc.config.tagKey)
+	}
+
+	group := parquet.Group{
+		enc.config.timeKey: parquet.Timestamp(parquet.Microsecond),
+		enc.config.tagKey:  parquet.String(),
+	}
+	for _, col := range columns {
+		if col.name == enc.config.timeKey || col.name == enc.config.tagKey {
+			continue
+		}
+		group[col.name] = parquet.Optional(parquetNode(col.typ))
+	}
+	schema := parquet.NewSchema("log", group)
+
+	cw := &countingWriter{w: w}
+	pw := parquet.NewWriter(cw, schema,
+		parquet.Compression(enc.config.codec()),
+		parquet.MaxRowsPerRowGroup(enc.config.rowGroupSize),
+		parquet.CreatedBy("flb-output-gcs", VERSION, ""),
+	)
+
+	for _, rec := range enc.records {
+		row := make(map[string]any, len(columns)+2)
+		for _, col := range columns {
+			if val := columnValue(col.typ, rec.fields[col.name]); val != nil {
+				row[col.name] = val
+			}
+		}
+		row[enc.config.timeKey] = time.UnixMicro(int64(math.Round(rec.timestamp * 1e6)))
+		row[enc.config.tagKey] = rec.tag
+		if err := pw.Write(row); err != nil {
+			return cw.n, err
+		}
+	}
+
+	enc.records = nil
+	enc.size = 0
+
+	err := pw.Close()
+	return cw.n, err
+}
+
+// parquetNode parquet schema node for a column type
+func parquetNode(typ columnType) parquet.Node {
+	switch typ {
+	case columnInt64:
+		return parquet.Int(64)
+	case columnDouble:
+		return parquet.Leaf(parquet.DoubleType)
+	case columnBoolean:
+		return parquet.Leaf(parquet.BooleanType)
+	default:
+		return parquet.String()
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// readParquetForTest read every row of a parquet file held in memory
+func readParquetForTest(t *testing.T, b []byte) (*parquet.File, []map[string]any) {
+	t.Helper()
+	f, err := parquet.OpenFile(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("not a valid parquet file: %s", err)
+	}
+	reader := parquet.NewReader(f)
+	var rows []map[string]any
+	for {
+		row := map[string]any{}
+		if err := reader.Read(&row); err != nil {
+			break
+		}
+		rows = append(rows, row)
+	}
+	return f, rows
+}
+
+// Test_parseParquetSchema do we accept well-formed column lists and reject bad ones?
+func Test_parseParquetSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []recordColumn
+		wantErr bool
+	}{
+		{name: "good",
+			spec: "level:string, status:int64,latency:double,ok:boolean,",
+			want: []recordColumn{{"level", columnString}, {"status", columnInt64}, {"latency", columnDouble}, {"ok", columnBoolean}}},
+		{name: "no type", spec: "level", wantErr: true},
+		{name: "bad type", spec: "level:varchar", wantErr: true},
+		{name: "empty", spec: " , ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseParquetSchema(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseParquetSchema(%s) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wanted: %#v got: %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+// Test_parquetObjectEncoder do we write a readable parquet file with an inferred or declared schema?
+func Test_parquetObjectEncoder(t *testing.T) {
+	ts := float64(time.Date(2022, 2, 17, 0, 16, 0, 500000000, time.UTC).UnixMicro()) / 1e6
+	tests := []struct {
+		name    string
+		columns []recordColumn
+		want    []map[string]any
+	}{
+		{name: "inferred",
+			want: []map[string]any{
+				{"timestamp": int64(1645056960500000), "tag": "cpu", "msg": "hello", "n": int64(3), "ok": nil},
+				{"timestamp": int64(1645056960500000), "tag": "cpu", "msg": nil, "n": int64(4), "ok": true},
+			}},
+		{name: "declared",
+			columns: []recordColumn{{"n", columnDouble}, {"msg", columnString}, {"absent", columnBoolean}},
+			want: []map[string]any{
+				{"timestamp": int64(1645056960500000), "tag": "cpu", "msg": "hello", "n": 3.0, "absent": nil},
+				{"timestamp": int64(1645056960500000), "tag": "cpu", "msg": nil, "n": 4.0, "absent": nil},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &parquetEncoderConfig{columns: tt.columns, compression: CompressionGzip, rowGroupSize: 1, timeKey: "timestamp", tagKey: "tag"}
+			enc := cfg.NewObjectEncoder()
+			enc.AddRecord("cpu", ts, logFields{"msg": "hello", "n": int64(3)})
+			enc.AddRecord("cpu", ts, logFields{"n": uint16(4), "ok": true})
+
+			if enc.Size() == 0 {
+				t.Error("Size() did not account for the added records")
+			}
+
+			buf := new(bytes.Buffer)
+			written, err := enc.WriteTo(buf)
+			if err != nil {
+				t.Fatalf("WriteTo() returned %s", err)
+			}
+			if written != int64(buf.Len()) {
+				t.Errorf("WriteTo() reported %d bytes but wrote %d", written, buf.Len())
+			}
+
+			f, rows := readParquetForTest(t, buf.Bytes())
+			if len(f.RowGroups()) != 2 {
+				t.Errorf("wanted 2 row groups, got %d", len(f.RowGroups()))
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("wanted: %#v got: %#v", tt.want, rows)
+			}
+		})
+	}
+}
+
+// Test_PutRecord_parquet_commit do we hold records until commit, then write one parquet object?
+func Test_PutRecord_parquet_commit(t *testing.T) {
+	cli, _ := sapi.NewClient(context.Background(), storageConfig{})
+
+	work2 := newWork2()
+	work2.encoderFactory = &parquetEncoderConfig{rowGroupSize: 100, timeKey: "timestamp", tagKey: "tag"}
+
+	work2.PutRecord(context.Background(), cli, "mermermy", 1645056960.5, logFields{"msg": "hello"})
+	wri := work2.Writer.(*storageWriterForTest)
+	if wri.buf.Len() != 0 {
+		t.Errorf("PutRecord() wrote %d bytes before commit", wri.buf.Len())
+	}
+
+	want := `^\d{8}T\d{6}Z-[-\da-f]{36}\.parquet$`
+	if rx := regexp.MustCompile(want); rx.FindStringIndex(work2.objectPath) == nil {
+		t.Errorf("wanted: `%s` got: `%s`", want, work2.objectPath)
+	}
+
+	work2.Commit()
+
+	if work2.Written != int64(wri.buf.Len()) || work2.Written == 0 {
+		t.Errorf("Written = %d, but the object has %d bytes", work2.Written, wri.buf.Len())
+	}
+	if _, rows := readParquetForTest(t, wri.buf.Bytes()); len(rows) != 1 || rows[0]["msg"] != "hello" {
+		t.Errorf("committed object has rows %#v", rows)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// partitionDefault the value of a partition key that a record doesn't have, as Hive names it
+const partitionDefault = "__HIVE_DEFAULT_PARTITION__"
+
+// partitionValues pull the values of the partition keys out of a record's fields, ready to use in an object path.
+// Returns nil when there are no partition keys.
+//
+// Values are escaped like a path segment, so a value with a "/" can't add
+// directories to the path.
+func partitionValues(keys []string, fields logFields) map[string]string {
+	if len(keys) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		val := csvValue(fields[key])
+		if val == "" {
+			val = partitionDefault
+		}
+		values[key] = url.PathEscape(val)
+	}
+	return values
+}
+
+// partitionWorkerKey the key of the worker for a tag and partition, in outputState.workers
+func partitionWorkerKey(tag string, keys []string, values map[string]string) string {
+	if len(keys) == 0 {
+		return tag
+	}
+	var b strings.Builder
+	b.WriteString(tag)
+	for _, key := range keys {
+		// no tag, key or escaped value has a NUL in it
+		b.WriteByte(0)
+		b.WriteString(values[key])
+	}
+	return b.String()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Test_partitionValues do we get a path-safe value for every partition key, and a default for the missing ones?
+func Test_partitionValues(t *testing.T) {
+	fields := logFields{"service": "api", "level": "error", "code": 503, "path": "/v1/a b"}
+	tests := []struct {
+		name string
+		keys []string
+		want map[string]string
+	}{
+		{name: "no keys", keys: nil, want: nil},
+		{name: "strings", keys: []string{"service", "level"}, want: map[string]string{"service": "api", "level": "error"}},
+		{name: "number", keys: []string{"code"}, want: map[string]string{"code": "503"}},
+		{name: "escaped", keys: []string{"path"}, want: map[string]string{"path": "%2Fv1%2Fa%20b"}},
+		{name: "missing", keys: []string{"host"}, want: map[string]string{"host": "__HIVE_DEFAULT_PARTITION__"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partitionValues(tt.keys, fields); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("partitionValues() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_partitionWorkerKey do different partitions of a tag get different workers, and no partitions just the tag?
+func Test_partitionWorkerKey(t *testing.T) {
+	keys := []string{"a", "b"}
+	if got := partitionWorkerKey("cpu", nil, nil); got != "cpu" {
+		t.Errorf("partitionWorkerKey() without keys = %q", got)
+	}
+	k1 := partitionWorkerKey("cpu", keys, map[string]string{"a": "x", "b": "yz"})
+	k2 := partitionWorkerKey("cpu", keys, map[string]string{"a": "xy", "b": "z"})
+	if k1 == k2 {
+		t.Errorf("partitions x/yz and xy/z have the same worker key %q", k1)
+	}
+}
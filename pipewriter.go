@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+)
+
+// pipeWriter an IStorageWriter for SDKs that upload an object from an io.Reader.
+//
+// What is written is piped to upload, which runs on its own goroutine. It is
+// started by the first Write (or by Close, for an empty object), once the
+// chunk size has been set. upload can read the commit metadata once it has
+// read all of body.
+type pipeWriter struct {
+	chunkSize      int
+	attrs          objectAttrs
+	commitMetadata map[string]string
+
+	upload func(body io.Reader, pw *pipeWriter) error
+
+	pipe *io.PipeWriter
+	done chan error
+}
+
+// newPipeWriter constructor
+func newPipeWriter(attrs objectAttrs, upload func(body io.Reader, pw *pipeWriter) error) *pipeWriter {
+	return &pipeWriter{attrs: attrs, upload: upload}
+}
+
+func (pw *pipeWriter) SetChunkSize(n int) {
+	pw.chunkSize = n
+}
+
+func (pw *pipeWriter) SetCommitMetadata(metadata map[string]string) {
+	pw.commitMetadata = metadata
+}
+
+// start the upload goroutine
+func (pw *pipeWriter) start() {
+	body, pipe := io.Pipe()
+	pw.pipe = pipe
+	pw.done = make(chan error, 1)
+	go func() {
+		err := pw.upload(body, pw)
+		// a failed upload fails the writes still to come, instead of leaving them blocked
+		body.CloseWithError(err)
+		pw.done <- err
+	}()
+}
+
+func (pw *pipeWriter) Write(p []byte) (int, error) {
+	if pw.pipe == nil {
+		pw.start()
+	}
+	return pw.pipe.Write(p)
+}
+
+// Abort fail the upload's read of the body, so the SDK gives up on the object
+func (pw *pipeWriter) Abort() {
+	if pw.pipe == nil {
+		return
+	}
+	pw.pipe.CloseWithError(errAborted)
+	<-pw.done
+}
+
+// Close finish the upload and return its error
+func (pw *pipeWriter) Close() error {
+	if pw.pipe == nil {
+		pw.start()
+	}
+	pw.pipe.Close()
+	return <-pw.done
+}
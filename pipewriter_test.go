@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Test_pipeWriter does the upload get what was written, with its attributes and the commit metadata?
+// Does a failed upload fail the writer?
+func Test_pipeWriter(t *testing.T) {
+	var got bytes.Buffer
+	pw := newPipeWriter(objectAttrs{ContentType: "text/csv"}, func(body io.Reader, pw *pipeWriter) error {
+		_, err := io.Copy(&got, body)
+		return err
+	})
+	pw.SetChunkSize(1024)
+	pw.Write([]byte("abc"))
+	pw.Write([]byte("def"))
+	pw.SetCommitMetadata(map[string]string{"a": "1"})
+	if err := pw.Close(); err != nil {
+		t.Errorf("Close() %s", err)
+	}
+	if got.String() != "abcdef" || pw.attrs.ContentType != "text/csv" {
+		t.Errorf("uploaded '%s' as %s", got.String(), pw.attrs.ContentType)
+	}
+	if pw.commitMetadata["a"] != "1" {
+		t.Errorf("commit metadata %v", pw.commitMetadata)
+	}
+
+	failed := errors.New("injected failure")
+	pw = newPipeWriter(objectAttrs{}, func(body io.Reader, pw *pipeWriter) error {
+		return failed
+	})
+	if _, err := pw.Write([]byte("abc")); err != failed {
+		t.Errorf("Write() to a failed upload returned %v", err)
+	}
+	if err := pw.Close(); err != failed {
+		t.Errorf("Close() of a failed upload returned %v", err)
+	}
+
+	empty := 0
+	pw = newPipeWriter(objectAttrs{}, func(body io.Reader, pw *pipeWriter) error {
+		bb, err := io.ReadAll(body)
+		empty = len(bb) + 1
+		return err
+	})
+	if err := pw.Close(); err != nil || empty != 1 {
+		t.Errorf("Close() of an empty object returned %v, uploading %d bytes", err, empty-1)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// retryPolicy how many times, and how patiently, to retry a failed upload
+type retryPolicy struct {
+	// number of retries after the first attempt
+	attempts int
+
+	// backoff before the first retry; doubled for each retry after that, up to maxBackoff
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// output instance whose uploads these are, for the metrics
+	outputID string
+
+	// replaced in tests
+	sleep func(context.Context, time.Duration)
+}
+
+// NewRetryPolicy constructor
+func NewRetryPolicy(attempts int, backoffSeconds int) *retryPolicy {
+	return &retryPolicy{
+		attempts:   attempts,
+		backoff:    time.Duration(backoffSeconds) * time.Second,
+		maxBackoff: 60 * time.Second,
+		sleep:      sleepContext,
+	}
+}
+
+// sleepContext sleep for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// delay exponential backoff before retry number attempt (1-based), with jitter so
+// that objects failing together don't all retry together
+func (rp *retryPolicy) delay(attempt int) time.Duration {
+	d := rp.backoff
+	for i := 1; i < attempt && d < rp.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// somewhere in [d/2, d]
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// run call upload until it succeeds, the retries are used up or ctx is done, and return the last error
+func (rp *retryPolicy) run(ctx context.Context, meta *spoolMeta, upload func() error) error {
+	return rp.retry(ctx, meta, upload(), upload)
+}
+
+// retry like run, for an upload that has already failed once with err
+func (rp *retryPolicy) retry(ctx context.Context, meta *spoolMeta, err error, upload func() error) error {
+	for attempt := 1; err != nil && attempt <= rp.attempts; attempt++ {
+		wait := rp.delay(attempt)
+		logger.Warn().Str("object", meta.url()).Int("attempt", attempt).Int("attempts", rp.attempts).Dur("backoff", wait).Err(err).Msg("upload failed, retrying")
+		rp.sleep(ctx, wait)
+		if ctx.Err() != nil {
+			break
+		}
+		metrics.uploadRetries.WithLabelValues(rp.outputID, meta.Metadata[metadataTag]).Inc()
+		err = upload()
+	}
+	if err != nil {
+		metrics.commitFailures.WithLabelValues(rp.outputID, meta.Metadata[metadataTag]).Inc()
+	}
+	return err
+}
+
+// uploadObject write content to a new generation of the object described by meta; the upload fails if ctx is done
+// before it's finished
+func uploadObject(ctx context.Context, client IStorageClient, meta *spoolMeta, content io.Reader) error {
+	w := client.NewWriterFromBucketObjectPath(meta.Bucket, meta.ObjectPath, meta.objectAttrs, ctx)
+	if meta.ChunkSize > 0 {
+		w.SetChunkSize(meta.ChunkSize)
+	}
+	if _, err := io.Copy(w, content); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// writeDeadLetter keep the content of an object we gave up on, as <id>.data with a sidecar <id>.json like a
+// spool file's, and return the path of the data
+func writeDeadLetter(dir string, meta *spoolMeta, content io.Reader) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	base := filepath.Join(dir, uuid.New().String())
+	f, err := os.OpenFile(base+".data", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	text, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	return base + ".data", os.WriteFile(base+".json", text, 0o600)
+}
+
+// retryClient an IStorageClient that keeps a copy of each object's content in memory (up to bufferMax bytes),
+// so an object whose upload fails can be uploaded again in the background.
+//
+// An object that can't be uploaded after all the retries goes to deadLetterDir, when one is set.
+type retryClient struct {
+	client        IStorageClient
+	policy        *retryPolicy
+	bufferMax     int64
+	deadLetterDir string
+	pending       sync.WaitGroup
+
+	// the objects being uploaded by Close, or retried in the background, until they're uploaded or given up on
+	mutex    sync.Mutex
+	retrying map[*spoolMeta]*retryingObject
+}
+
+// retryingObject the content of an object being uploaded or retried, and how to stop its retries (nil while it's
+// first uploaded)
+type retryingObject struct {
+	content []byte
+	cancel  context.CancelFunc
+}
+
+// NewRetryClient constructor
+func NewRetryClient(client IStorageClient, policy *retryPolicy, bufferMax int64, deadLetterDir string) *retryClient {
+	return &retryClient{client: client, policy: policy, bufferMax: bufferMax, deadLetterDir: deadLetterDir, retrying: map[*spoolMeta]*retryingObject{}}
+}
+
+func (rc *retryClient) NewWriterFromBucketObjectPath(bucket, path string, attrs objectAttrs, ctx context.Context) IStorageWriter {
+	return &retryWriter{
+		client:  rc,
+		meta:    spoolMeta{Bucket: bucket, ObjectPath: path, objectAttrs: attrs, EncryptionKeySHA256: attrs.encryptionKeySHA256(), Complete: true},
+		writer:  rc.client.NewWriterFromBucketObjectPath(bucket, path, attrs, ctx),
+		content: new(bytes.Buffer),
+	}
+}
+
+func (rc *retryClient) CheckBucket(ctx context.Context, bucket string) error {
+	return checkBucket(ctx, rc.client, bucket)
+}
+
+// Drain wait for the objects being retried in the background
+func (rc *retryClient) Drain() {
+	rc.pending.Wait()
+}
+
+// Abandon stop the retries of the objects still being retried, and keep each in deadLetterDir, when one is set,
+// along with the objects whose first upload hasn't finished
+//
+// A retry is cancelled before its object is kept, so that it isn't also
+// uploaded, unless its upload finished just as it was cancelled. An object
+// still being closed is not retried once it was abandoned.
+func (rc *retryClient) Abandon() []shutdownResult {
+	rc.mutex.Lock()
+	retrying := rc.retrying
+	rc.retrying = map[*spoolMeta]*retryingObject{}
+	rc.mutex.Unlock()
+
+	var abandoned []shutdownResult
+	for meta, obj := range retrying {
+		if obj.cancel != nil {
+			obj.cancel()
+		}
+		res := shutdownResult{object: meta.url(), err: errShutdownTimeout}
+		if rc.deadLetterDir != "" {
+			if path, err := writeDeadLetter(rc.deadLetterDir, meta, bytes.NewReader(obj.content)); err != nil {
+				res.err = errors.Join(res.err, err)
+			} else {
+				res.kept = path
+			}
+		}
+		abandoned = append(abandoned, res)
+	}
+	return abandoned
+}
+
+// retry upload an object again until it succeeds, we give up on it, or ctx is cancelled because it was abandoned
+func (rc *retryClient) retry(ctx context.Context, meta *spoolMeta, content []byte, err error) {
+	defer rc.pending.Done()
+	defer inFlight.hold(-int64(len(content)))
+
+	object := meta.url()
+	logger.Warn().Str("object", object).Int("attempts", rc.policy.attempts).Err(err).Msg("commit failed, retrying in the background")
+
+	err = rc.policy.retry(ctx, meta, err, func() error {
+		return uploadObject(ctx, rc.client, meta, bytes.NewReader(content))
+	})
+
+	// an object abandoned at exit was already kept in deadLetterDir
+	rc.mutex.Lock()
+	_, tracked := rc.retrying[meta]
+	delete(rc.retrying, meta)
+	rc.mutex.Unlock()
+
+	if err == nil {
+		logger.Info().Str("object", object).Float64("kib", float64(len(content))/1024.0).Msg("committed after retrying")
+		return
+	}
+
+	event := logger.Error().Str("object", object).Int("attempts", rc.policy.attempts).Err(err)
+	if rc.deadLetterDir != "" && tracked {
+		if path, dlerr := writeDeadLetter(rc.deadLetterDir, meta, bytes.NewReader(content)); dlerr != nil {
+			event = event.AnErr("deadLetterError", dlerr)
+		} else {
+			event = event.Str("deadLetter", path)
+		}
+	}
+	event.Msg("giving up on upload")
+}
+
+// retryWriter an IStorageWriter that copies what it writes, so it can be written again
+type retryWriter struct {
+	client  *retryClient
+	meta    spoolMeta
+	writer  IStorageWriter
+	content *bytes.Buffer // nil once the object is too big to keep
+	failed  error
+}
+
+func (rw *retryWriter) SetChunkSize(n int) {
+	rw.meta.ChunkSize = n
+	rw.writer.SetChunkSize(n)
+}
+
+// SetCommitMetadata a retry uploads the object again with all its metadata at once
+func (rw *retryWriter) SetCommitMetadata(metadata map[string]string) {
+	rw.meta.objectAttrs = rw.meta.withMetadata(metadata)
+	rw.writer.SetCommitMetadata(metadata)
+}
+
+// Write write to the upload and keep a copy
+//
+// Once the upload has failed, writes go only to the copy, and the object is
+// retried when it is closed.
+func (rw *retryWriter) Write(p []byte) (int, error) {
+	if rw.content != nil {
+		if int64(rw.content.Len()+len(p)) <= rw.client.bufferMax {
+			rw.content.Write(p)
+		} else {
+			logger.Debug().Str("object", rw.meta.url()).Msg("object is too big to keep for retries")
+			rw.content = nil
+		}
+	}
+
+	if rw.failed != nil {
+		if rw.content == nil {
+			return 0, rw.failed
+		}
+		return len(p), nil
+	}
+
+	n, err := rw.writer.Write(p)
+	if err != nil {
+		rw.failed = err
+		if rw.content != nil {
+			return len(p), nil
+		}
+	}
+	return n, err
+}
+
+// Abort give up on the upload, and on the copy
+func (rw *retryWriter) Abort() {
+	rw.content = nil
+	rw.writer.Abort()
+}
+
+// Close finish the upload; if it fails, and we still have the content, hand it to a background retry
+func (rw *retryWriter) Close() error {
+	if rw.content == nil {
+		if rw.failed != nil {
+			return rw.failed
+		}
+		return rw.writer.Close()
+	}
+
+	// while the upload finishes, the copy can be abandoned at exit like a retry
+	rw.client.mutex.Lock()
+	rw.client.retrying[&rw.meta] = &retryingObject{content: rw.content.Bytes()}
+	rw.client.mutex.Unlock()
+	err := rw.failed
+	if err == nil {
+		err = rw.writer.Close()
+	}
+	rw.client.mutex.Lock()
+	defer rw.client.mutex.Unlock()
+	if _, tracked := rw.client.retrying[&rw.meta]; !tracked || err == nil {
+		// an object abandoned meanwhile was already kept in deadLetterDir
+		delete(rw.client.retrying, &rw.meta)
+		return err
+	}
+
+	// the copy is held in memory until the retries are done
+	inFlight.hold(int64(rw.content.Len()))
+	ctx, cancel := context.WithCancel(context.Background())
+	rw.client.pending.Add(1)
+	rw.client.retrying[&rw.meta] = &retryingObject{content: rw.content.Bytes(), cancel: cancel}
+	go func() {
+		defer cancel()
+		rw.client.retry(ctx, &rw.meta, rw.content.Bytes(), err)
+	}()
+	return nil
+}
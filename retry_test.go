@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// noWaitRetryPolicy a retryPolicy for tests, which doesn't actually sleep
+func noWaitRetryPolicy(attempts int) *retryPolicy {
+	rp := NewRetryPolicy(attempts, 1)
+	rp.sleep = func(context.Context, time.Duration) {}
+	return rp
+}
+
+// Test_retryPolicy_delay does the backoff grow exponentially, with jitter, up to the maximum?
+func Test_retryPolicy_delay(t *testing.T) {
+	rp := NewRetryPolicy(10, 2)
+	for attempt, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 8 * time.Second, 9: 60 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if got := rp.delay(attempt); got < want/2 || got > want {
+				t.Errorf("delay(%d) = %s, wanted between %s and %s", attempt, got, want/2, want)
+			}
+		}
+	}
+}
+
+// Test_retryClient is an object whose commit failed uploaded again in the background, or dead-lettered?
+func Test_retryClient(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		bufferMax    int64
+		wantCloseErr bool
+		uploaded     bool
+		deadLettered bool
+	}{
+		{name: "no failure", failures: 0, bufferMax: 100, uploaded: true},
+		{name: "retried", failures: 3, bufferMax: 100, uploaded: true},
+		{name: "given up", failures: 4, bufferMax: 100, deadLettered: true},
+		{name: "too big to keep", failures: 1, bufferMax: 3, wantCloseErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dldir := t.TempDir()
+			cli := &storageClientForTest{failures: tt.failures}
+			rc := NewRetryClient(cli, noWaitRetryPolicy(3), tt.bufferMax, dldir)
+
+			w := rc.NewWriterFromBucketObjectPath("b", "obj", objectAttrs{ContentType: "text/csv"}, context.Background())
+			w.Write([]byte("hello"))
+			if err := w.Close(); (err != nil) != tt.wantCloseErr {
+				t.Errorf("Close() returned %v", err)
+			}
+			rc.Drain()
+
+			got := cli.objects["b/obj"]
+			if tt.uploaded && (got.closeErr != nil || got.buf.String() != "hello" || got.attrs.ContentType != "text/csv") {
+				t.Errorf("b/obj was not uploaded: %#v", got)
+			}
+			dead, _ := filepath.Glob(filepath.Join(dldir, "*.data"))
+			if (len(dead) == 1) != tt.deadLettered {
+				t.Fatalf("dead letters: %v", dead)
+			}
+			if tt.deadLettered {
+				if bb, _ := os.ReadFile(dead[0]); !bytes.Equal(bb, []byte("hello")) {
+					t.Errorf("dead letter has '%s'", bb)
+				}
+			}
+		})
+	}
+}
+
+// Test_retryClient_Abandon is the retry of an abandoned object stopped, so that it isn't uploaded as well as kept in
+// deadLetterDir?
+func Test_retryClient_Abandon(t *testing.T) {
+	policy := noWaitRetryPolicy(3)
+	policy.sleep = func(ctx context.Context, d time.Duration) { <-ctx.Done() }
+	dldir := t.TempDir()
+	cli := &storageClientForTest{failures: 1}
+	rc := NewRetryClient(cli, policy, 100, dldir)
+
+	w := rc.NewWriterFromBucketObjectPath("b", "obj", objectAttrs{}, context.Background())
+	w.Write([]byte("hello"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned %s", err)
+	}
+	failed := cli.objects["b/obj"]
+
+	abandoned := rc.Abandon()
+	rc.Drain()
+	if len(abandoned) != 1 || abandoned[0].kept == "" {
+		t.Fatalf("abandoned %#v, wanted the object kept", abandoned)
+	}
+	if cli.objects["b/obj"] != failed {
+		t.Error("the object was uploaded again after it was abandoned")
+	}
+	if dead, _ := filepath.Glob(filepath.Join(dldir, "*.data")); len(dead) != 1 {
+		t.Errorf("dead letters: %v", dead)
+	}
+}
+
+// Test_Commit_failure is the worker ready for a new object after a commit fails?
+func Test_Commit_failure(t *testing.T) {
+	cli := &storageClientForTest{failures: 1}
+
+	work2 := newWork2()
+	work2.Put(cli, *bytes.NewBufferString("abc"))
+
+	if err := work2.Commit(); err == nil {
+		t.Error("Commit() should have returned the upload failure")
+	}
+	if work2.Writer != nil {
+		t.Error("Writer is dangling on a worker after a failed commit")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	// the time zones are built in, since fluent-bit images often have no zoneinfo
+	_ "time/tzdata"
+)
+
+// RotateBoundary the wall-clock windows that objects are aligned to: none, minute, hour or day
+type RotateBoundary string
+
+const (
+	RotateNone   RotateBoundary = "none"
+	RotateMinute RotateBoundary = "minute"
+	RotateHour   RotateBoundary = "hour"
+	RotateDay    RotateBoundary = "day"
+)
+
+// windowEnd the end of the window that t falls into, in t's time zone; the zero time when there are no windows
+//
+// Minutes and hours are counted from the zone's offset at t, so an hour in a zone like +05:30 begins at hh:30 UTC,
+// and a day is a calendar day, however long daylight saving time makes it.
+func (rb RotateBoundary) windowEnd(t time.Time) time.Time {
+	var length time.Duration
+	switch rb {
+	case RotateMinute:
+		length = time.Minute
+	case RotateHour:
+		length = time.Hour
+	case RotateDay:
+		year, month, day := t.Date()
+		return time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Time{}
+	}
+
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(length).Add(length).Add(-shift)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Test_RotateBoundary_windowEnd does each window end on the minute, hour or day of its time zone, including zones
+// with a half-hour offset and days made longer or shorter by daylight saving time?
+func Test_RotateBoundary_windowEnd(t *testing.T) {
+	kolkata, _ := time.LoadLocation("Asia/Kolkata")
+	newYork, _ := time.LoadLocation("America/New_York")
+
+	tests := []struct {
+		name     string
+		boundary RotateBoundary
+		t        time.Time
+		want     time.Time
+	}{
+		{"none", RotateNone, time.Date(2024, 3, 9, 10, 20, 30, 0, time.UTC), time.Time{}},
+		{"minute", RotateMinute, time.Date(2024, 3, 9, 10, 20, 30, 0, time.UTC), time.Date(2024, 3, 9, 10, 21, 0, 0, time.UTC)},
+		{"hour", RotateHour, time.Date(2024, 3, 9, 10, 20, 30, 0, time.UTC), time.Date(2024, 3, 9, 11, 0, 0, 0, time.UTC)},
+		{"hour, on the hour", RotateHour, time.Date(2024, 3, 9, 10, 0, 0, 0, time.UTC), time.Date(2024, 3, 9, 11, 0, 0, 0, time.UTC)},
+		{"hour, half-hour offset", RotateHour, time.Date(2024, 3, 9, 10, 20, 30, 0, kolkata), time.Date(2024, 3, 9, 11, 0, 0, 0, kolkata)},
+		{"day", RotateDay, time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"day, 23 hours long", RotateDay, time.Date(2024, 3, 10, 1, 0, 0, 0, newYork), time.Date(2024, 3, 11, 0, 0, 0, 0, newYork)},
+		{"hour, before the clocks go forward", RotateHour, time.Date(2024, 3, 10, 1, 30, 0, 0, newYork), time.Date(2024, 3, 10, 3, 0, 0, 0, newYork)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.boundary.windowEnd(tt.t); !got.Equal(tt.want) {
+				t.Errorf("windowEnd(%s) = %s, wanted %s", tt.t, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"sync"
+	"time"
+)
+
+var (
+	// errShutdownTimeout an object that was still being committed at the end of ShutdownTimeoutSeconds
+	errShutdownTimeout = errors.New("not committed within ShutdownTimeoutSeconds")
+
+	// errNotUploaded an object that was committed to the spool, but not uploaded from it
+	errNotUploaded = errors.New("not uploaded from the spool")
+)
+
+// shutdownResult what became of one object at exit
+type shutdownResult struct {
+	outputID string
+
+	// key of the worker (its tag, and partition) that wrote the object; blank when the object was already
+	// committed, and only its upload was pending
+	worker string
+
+	// gs:// url of the object, when it is known
+	object string
+
+	// nil when the object was committed
+	err error
+
+	// where the object was kept when it wasn't committed: a spool file, uploaded at the next start, or a
+	// dead-letter file, which is left to be uploaded by hand
+	kept string
+
+	// whether kept is a spool file
+	spooled bool
+}
+
+// shutdownInstances commit the open objects of every output instance, and wait for their uploads. The instances
+// shut down all at once, each within its own shutdownTimeoutSeconds, and an instance is only shut down once
+func shutdownInstances(insts map[string]*outputState) []shutdownResult {
+	var (
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		results []shutdownResult
+	)
+	for _, inst := range insts {
+		inst.mutex.Lock()
+		exited := inst.exited
+		inst.exited = true
+		inst.mutex.Unlock()
+		if exited {
+			continue
+		}
+		wg.Add(1)
+		go func(inst *outputState) {
+			defer wg.Done()
+			instResults := inst.shutdown()
+			mutex.Lock()
+			results = append(results, instResults...)
+			mutex.Unlock()
+		}(inst)
+	}
+	wg.Wait()
+	return results
+}
+
+// shutdown close every worker of the instance in parallel, so each commits its object, and then wait for the
+// objects to be uploaded, until the deadline
+//
+// Whatever isn't committed by the deadline is left for later: spool files stay in the spool (and are uploaded at
+// the next start), and objects being retried from memory go to the dead-letter directory, if there is one, to be
+// uploaded by hand.
+func (state *outputState) shutdown() []shutdownResult {
+	logger.Debug().Str("outputID", state.outputID).Msgf("cleaning up instance %s", state.outputID)
+	deadline := time.NewTimer(time.Duration(state.shutdownTimeoutSeconds) * time.Second)
+	defer deadline.Stop()
+
+	state.mutex.Lock()
+	workers := maps.Clone(state.workers)
+	state.mutex.Unlock()
+
+	type closed struct {
+		key string
+		shutdownResult
+	}
+	done := make(chan closed, len(workers))
+	// the object of each worker, so one still being committed at the deadline can be matched with its copy
+	var objectsMutex sync.Mutex
+	objects := map[string]string{}
+	for key, work := range workers {
+		go func(key string, work *ObjectWorker) {
+			object := work.Status().Object
+			objectsMutex.Lock()
+			objects[key] = object
+			objectsMutex.Unlock()
+			done <- closed{key, shutdownResult{outputID: state.outputID, worker: key, object: object, err: work.Close()}}
+		}(key, work)
+	}
+
+	// the workers that haven't closed yet, and the objects they committed (or failed to)
+	open := map[string]bool{}
+	for key := range workers {
+		open[key] = true
+	}
+	var results []shutdownResult
+	timedOut := false
+	for len(open) > 0 && !timedOut {
+		select {
+		case c := <-done:
+			delete(open, c.key)
+			// a worker without an object had nothing to commit
+			if c.object != "[closed]" {
+				results = append(results, c.shutdownResult)
+			}
+		case <-deadline.C:
+			timedOut = true
+		}
+	}
+	objectsMutex.Lock()
+	for key := range open {
+		results = append(results, shutdownResult{outputID: state.outputID, worker: key, object: objects[key], err: errShutdownTimeout})
+	}
+	objectsMutex.Unlock()
+
+	// the uploads can only be waited for once no worker can commit another object
+	if !timedOut {
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			switch cli := state.gcsClient.(type) {
+			case *spoolClient:
+				cli.Drain()
+			case *retryClient:
+				cli.Drain()
+			}
+		}()
+		select {
+		case <-drained:
+		case <-deadline.C:
+		}
+	}
+
+	// what's left to upload is kept for later
+	var left []shutdownResult
+	switch cli := state.gcsClient.(type) {
+	case *spoolClient:
+		left = cli.Pending()
+	case *retryClient:
+		left = cli.Abandon()
+	}
+	for _, lr := range left {
+		lr.outputID = state.outputID
+		results = mergeShutdownResult(results, lr)
+	}
+
+	reportShutdown(state.outputID, results)
+	return results
+}
+
+// mergeShutdownResult add what became of an object's upload to the result of its commit (or of the commit that
+// didn't finish), if there is one
+func mergeShutdownResult(results []shutdownResult, upload shutdownResult) []shutdownResult {
+	for i := range results {
+		if results[i].object == upload.object && results[i].kept == "" {
+			results[i].err = upload.err
+			results[i].kept = upload.kept
+			results[i].spooled = upload.spooled
+			return results
+		}
+	}
+	return append(results, upload)
+}
+
+// reportShutdown log what became of each object of an instance, and a summary
+func reportShutdown(outputID string, results []shutdownResult) {
+	committed, kept, lost := 0, 0, 0
+	for _, res := range results {
+		switch {
+		case res.err == nil:
+			committed++
+			logger.Debug().Str("outputID", outputID).Str("object", res.object).Msg("committed at exit")
+		case res.spooled:
+			kept++
+			logger.Warn().Str("outputID", outputID).Str("worker", res.worker).Str("object", res.object).Str("kept", res.kept).Err(res.err).Msg("not committed at exit; kept in the spool, to be uploaded at the next start")
+		case res.kept != "":
+			kept++
+			logger.Warn().Str("outputID", outputID).Str("worker", res.worker).Str("object", res.object).Str("kept", res.kept).Err(res.err).Msg("not committed at exit; kept in DeadLetterDir, to be uploaded by hand")
+		default:
+			lost++
+			logger.Error().Str("outputID", outputID).Str("worker", res.worker).Str("object", res.object).Err(res.err).Msg("not committed at exit")
+		}
+	}
+	logger.Info().Str("outputID", outputID).Int("committed", committed).Int("kept", kept).Int("lost", lost).Msg("shut down")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newShutdownStateForTest an instance writing through client, with a worker for each tag that has an open object
+func newShutdownStateForTest(outputID string, client IStorageClient, tags ...string) *outputState {
+	state := &outputState{
+		bucket:                 "bucketymcbucketface.example.com",
+		bufferSizeKiB:          19,
+		bufferTimeoutSeconds:   300,
+		compression:            CompressionNone,
+		encoder:                &legacyEncoder{},
+		gcsClient:              client,
+		objectNameTemplate:     outputID + "/{{ .InputTag }}/{{ .Uuid }}",
+		outputID:               outputID,
+		shutdownTimeoutSeconds: 1,
+		workers:                map[string]*ObjectWorker{},
+	}
+	for _, tag := range tags {
+		state.worker(tag, nil).Put(client, *bytes.NewBufferString(outputID + " " + tag + "\n"))
+	}
+	return state
+}
+
+// Test_shutdownInstances_sharedTag are the objects of every instance committed, when the instances have workers
+// for the same tag, and is an instance only shut down once?
+func Test_shutdownInstances_sharedTag(t *testing.T) {
+	cli1, cli2 := &storageClientForTest{}, &storageClientForTest{}
+	insts := map[string]*outputState{
+		"one": newShutdownStateForTest("one", cli1, "my-tag", "other-tag"),
+		"two": newShutdownStateForTest("two", cli2, "my-tag"),
+	}
+
+	results := shutdownInstances(insts)
+	if len(results) != 3 {
+		t.Fatalf("%d results, wanted 3: %v", len(results), results)
+	}
+	for _, res := range results {
+		if res.err != nil || res.object == "" {
+			t.Errorf("%s %s (%s) was not committed: %v", res.outputID, res.worker, res.object, res.err)
+		}
+	}
+	for outputID, cli := range map[string]*storageClientForTest{"one": cli1, "two": cli2} {
+		for path, wri := range cli.objects {
+			if !bytes.HasPrefix(wri.buf.Bytes(), []byte(outputID+" ")) {
+				t.Errorf("%s has the records of another instance: '%s'", path, wri.buf.String())
+			}
+		}
+	}
+
+	if again := shutdownInstances(insts); len(again) != 0 {
+		t.Errorf("an instance was shut down twice: %v", again)
+	}
+}
+
+// Test_shutdown_timeout does a worker whose commit hangs keep the instance from shutting down for longer than
+// ShutdownTimeoutSeconds, and is it reported, along with the workers that did commit?
+func Test_shutdown_timeout(t *testing.T) {
+	hung := &storageClientForTest{closeWait: make(chan struct{})}
+	defer close(hung.closeWait)
+	state := newShutdownStateForTest("hung", hung, "my-tag")
+	fine := &storageClientForTest{}
+	state.worker("other-tag", nil).Put(fine, *bytes.NewBufferString("fine\n"))
+
+	begin := time.Now()
+	results := state.shutdown()
+	if elapsed := time.Since(begin); elapsed > 3*time.Second {
+		t.Errorf("shutdown took %s, with a timeout of 1s", elapsed)
+	}
+
+	byWorker := map[string]shutdownResult{}
+	for _, res := range results {
+		byWorker[res.worker] = res
+	}
+	if res := byWorker["my-tag"]; !errors.Is(res.err, errShutdownTimeout) {
+		t.Errorf("the hung worker was reported as %#v", res)
+	}
+	if res := byWorker["other-tag"]; res.err != nil {
+		t.Errorf("the other worker was reported as %#v", res)
+	}
+}
+
+// Test_shutdown_spool is an object whose upload hangs left in the spool at the deadline, to be uploaded at the next
+// start?
+func Test_shutdown_spool(t *testing.T) {
+	hung := &storageClientForTest{closeWait: make(chan struct{})}
+	defer close(hung.closeWait)
+	spc, err := NewSpoolClient(t.TempDir(), hung, noWaitRetryPolicy(0), "")
+	if err != nil {
+		t.Fatalf("NewSpoolClient() %s", err)
+	}
+	state := newShutdownStateForTest("spooled", spc, "my-tag")
+
+	results := state.shutdown()
+	if len(results) != 1 {
+		t.Fatalf("%d results, wanted 1: %v", len(results), results)
+	}
+	res := results[0]
+	if !errors.Is(res.err, errNotUploaded) || res.worker != "my-tag" || filepath.Dir(res.kept) != spc.dir || !res.spooled {
+		t.Fatalf("the object was reported as %#v", res)
+	}
+	if data, err := os.ReadFile(res.kept); err != nil || string(data) != "spooled my-tag\n" {
+		t.Errorf("the spool file has '%s' (%v)", data, err)
+	}
+}
+
+// Test_shutdown_deadLetter is an object still being retried from memory at the deadline kept in DeadLetterDir?
+func Test_shutdown_deadLetter(t *testing.T) {
+	policy := noWaitRetryPolicy(3)
+	wait := make(chan struct{})
+	defer close(wait)
+	policy.sleep = func(context.Context, time.Duration) { <-wait }
+	dldir := t.TempDir()
+	rc := NewRetryClient(&storageClientForTest{failures: 10}, policy, 1024, dldir)
+	state := newShutdownStateForTest("retried", rc, "my-tag")
+
+	results := state.shutdown()
+	if len(results) != 1 {
+		t.Fatalf("%d results, wanted 1: %v", len(results), results)
+	}
+	res := results[0]
+	if !errors.Is(res.err, errShutdownTimeout) || filepath.Dir(res.kept) != dldir || res.spooled {
+		t.Fatalf("the object was reported as %#v", res)
+	}
+	if data, err := os.ReadFile(res.kept); err != nil || string(data) != "retried my-tag\n" {
+		t.Errorf("the dead letter has '%s' (%v)", data, err)
+	}
+}
+
+// Test_shutdown_deadLetterClosing is an object whose first upload hangs at the deadline, without a spool, kept in
+// DeadLetterDir from the copy kept for retries, and reported once?
+func Test_shutdown_deadLetterClosing(t *testing.T) {
+	hung := &storageClientForTest{closeWait: make(chan struct{})}
+	defer close(hung.closeWait)
+	dldir := t.TempDir()
+	rc := NewRetryClient(hung, noWaitRetryPolicy(0), 1024, dldir)
+	state := newShutdownStateForTest("closing", rc, "my-tag")
+
+	results := state.shutdown()
+	if len(results) != 1 {
+		t.Fatalf("%d results, wanted 1: %v", len(results), results)
+	}
+	res := results[0]
+	if !errors.Is(res.err, errShutdownTimeout) || res.worker != "my-tag" || filepath.Dir(res.kept) != dldir || res.spooled {
+		t.Fatalf("the object was reported as %#v", res)
+	}
+	if data, err := os.ReadFile(res.kept); err != nil || string(data) != "closing my-tag\n" {
+		t.Errorf("the dead letter has '%s' (%v)", data, err)
+	}
+}
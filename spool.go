@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// a spool file is synced to disk once this many bytes were written to it since it last was, or once a write
+	// comes this long after it last was, and when it's closed
+	spoolSyncBytes    = 1024 * 1024
+	spoolSyncInterval = time.Second
+)
+
+// errSpoolDrained a spool file finished after the uploader was drained at exit; it's uploaded at the next start
+var errSpoolDrained = errors.New("the spool uploader was stopped at exit; the spool file is uploaded at the next start")
+
+// spoolMeta the sidecar (<id>.json) describing a spool file (<id>.spool): where it goes, and how to label it
+type spoolMeta struct {
+	Bucket     string `json:"bucket"`
+	ObjectPath string `json:"objectPath"`
+	ChunkSize  int    `json:"chunkSize,omitempty"`
+
+	// including the commit metadata, once the object was committed
+	objectAttrs
+
+	// hash of the customer-supplied key of the object, which is never kept here itself
+	EncryptionKeySHA256 string `json:"encryptionKeySha256,omitempty"`
+
+	// true once the object was committed; an incomplete spool file was left by a crash
+	Complete bool `json:"complete"`
+}
+
+// url the gs:// url of the object, for log messages
+func (meta *spoolMeta) url() string {
+	return fmt.Sprintf("gs://%s/%s", meta.Bucket, meta.ObjectPath)
+}
+
+// writeSpoolMeta write the sidecar file atomically, so a crash never leaves half of one
+func writeSpoolMeta(path string, meta *spoolMeta) error {
+	text, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, text, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// spoolClient an IStorageClient that writes each object to a local spool file first.
+//
+// Closing a spool writer hands the finished file to the uploader, which copies
+// it to the bucket through the real client and then deletes it.
+type spoolClient struct {
+	dir      string
+	uploader *spoolUploader
+}
+
+// NewSpoolClient constructor; spool files are kept in dir, and uploaded through client.
+// Failed uploads are retried by policy, and then moved to deadLetterDir if it is set.
+func NewSpoolClient(dir string, client IStorageClient, policy *retryPolicy, deadLetterDir string) (*spoolClient, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &spoolClient{dir: dir, uploader: newSpoolUploader(dir, client, policy, deadLetterDir)}, nil
+}
+
+func (spc *spoolClient) NewWriterFromBucketObjectPath(bucket, path string, attrs objectAttrs, ctx context.Context) IStorageWriter {
+	return &spoolWriter{
+		base:     filepath.Join(spc.dir, uuid.New().String()),
+		meta:     spoolMeta{Bucket: bucket, ObjectPath: path, objectAttrs: attrs, EncryptionKeySHA256: attrs.encryptionKeySHA256()},
+		uploader: spc.uploader,
+	}
+}
+
+func (spc *spoolClient) CheckBucket(ctx context.Context, bucket string) error {
+	return checkBucket(ctx, spc.uploader.client, bucket)
+}
+
+// SetEncryptionKey the customer-supplied key for uploading spool files that need one, including those left over
+// from a previous run; call this before Recover
+func (spc *spoolClient) SetEncryptionKey(key []byte) {
+	spc.uploader.encryptionKey = key
+}
+
+// Recover queue the spool files left over from a previous run for upload
+//
+// There may be more of them than the queue holds, so they're queued in the
+// background, and Recover doesn't wait for the uploads.
+func (spc *spoolClient) Recover() error {
+	metas, err := filepath.Glob(filepath.Join(spc.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	spc.uploader.recovering.Add(1)
+	go func() {
+		defer spc.uploader.recovering.Done()
+		for _, metaPath := range metas {
+			base := strings.TrimSuffix(metaPath, ".json")
+			logger.Info().Str("spool", base).Msg("recovering spool file from a previous run")
+			if spc.uploader.enqueue(base) != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Drain wait until every queued spool file has been uploaded (or failed to upload), and stop the uploader
+func (spc *spoolClient) Drain() {
+	spc.uploader.drain()
+}
+
+// Pending the objects whose spool files are still waiting to be uploaded (or were given up on); they are uploaded
+// at the next start
+func (spc *spoolClient) Pending() []shutdownResult {
+	metas, _ := filepath.Glob(filepath.Join(spc.dir, "*.json"))
+	var pending []shutdownResult
+	for _, metaPath := range metas {
+		// the uploader may be finishing with the file as we look
+		text, err := os.ReadFile(metaPath)
+		if err != nil {
+			continue
+		}
+		var meta spoolMeta
+		if json.Unmarshal(text, &meta) != nil {
+			continue
+		}
+		pending = append(pending, shutdownResult{object: meta.url(), err: errNotUploaded, kept: strings.TrimSuffix(metaPath, ".json") + ".spool", spooled: true})
+	}
+	return pending
+}
+
+// spoolWriter an IStorageWriter appending to a spool file
+type spoolWriter struct {
+	base     string
+	meta     spoolMeta
+	file     *os.File
+	uploader *spoolUploader
+
+	// bytes written since the file was last synced, and when it was
+	unsynced int64
+	syncedAt time.Time
+}
+
+func (spw *spoolWriter) SetChunkSize(n int) {
+	spw.meta.ChunkSize = n
+}
+
+// SetCommitMetadata the object is uploaded after it's committed, so this metadata goes with the rest
+func (spw *spoolWriter) SetCommitMetadata(metadata map[string]string) {
+	spw.meta.objectAttrs = spw.meta.withMetadata(metadata)
+}
+
+// Write append to the spool file, which survives the process dying from then on. The file is synced to disk every
+// spoolSyncBytes or spoolSyncInterval, so a crash of the machine can lose what was written since
+//
+// The file (and its sidecar) are created on the first write, once the chunk
+// size is known.
+func (spw *spoolWriter) Write(p []byte) (int, error) {
+	if spw.file == nil {
+		if err := writeSpoolMeta(spw.base+".json", &spw.meta); err != nil {
+			return 0, err
+		}
+		f, err := os.OpenFile(spw.base+".spool", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return 0, err
+		}
+		spw.file = f
+		spw.syncedAt = time.Now()
+	}
+	n, err := spw.file.Write(p)
+	spw.unsynced += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if spw.unsynced >= spoolSyncBytes || time.Since(spw.syncedAt) >= spoolSyncInterval {
+		return n, spw.sync()
+	}
+	return n, nil
+}
+
+// sync the spool file to disk
+func (spw *spoolWriter) sync() error {
+	spw.unsynced = 0
+	spw.syncedAt = time.Now()
+	return spw.file.Sync()
+}
+
+// Abort remove the spool file and its sidecar, so the object is neither uploaded nor recovered
+func (spw *spoolWriter) Abort() {
+	if spw.file == nil {
+		return
+	}
+	spw.file.Close()
+	os.Remove(spw.base + ".spool")
+	os.Remove(spw.base + ".json")
+}
+
+// Close finish the spool file and queue it for upload
+func (spw *spoolWriter) Close() error {
+	if spw.file == nil {
+		// nothing was written; there is no spool file, but there should still be an (empty) object
+		if _, err := spw.Write(nil); err != nil {
+			return err
+		}
+	}
+	if err := errors.Join(spw.sync(), spw.file.Close()); err != nil {
+		return err
+	}
+	spw.meta.Complete = true
+	if err := writeSpoolMeta(spw.base+".json", &spw.meta); err != nil {
+		return err
+	}
+	return spw.uploader.enqueue(spw.base)
+}
+
+// spoolUploader copies finished spool files to their buckets, one at a time, on its own goroutine
+type spoolUploader struct {
+	dir           string
+	client        IStorageClient
+	policy        *retryPolicy
+	deadLetterDir string
+	encryptionKey []byte
+	queue         chan string
+	done          sync.WaitGroup
+
+	// the goroutines of Recover still queueing spool files
+	recovering sync.WaitGroup
+
+	// true once the queue is closed by drain; guards sending on it
+	mutex   sync.Mutex
+	drained bool
+}
+
+func newSpoolUploader(dir string, client IStorageClient, policy *retryPolicy, deadLetterDir string) *spoolUploader {
+	upl := &spoolUploader{
+		dir:           dir,
+		client:        client,
+		policy:        policy,
+		deadLetterDir: deadLetterDir,
+		queue:         make(chan string, 1024),
+	}
+	upl.done.Add(1)
+	go upl.run()
+	return upl
+}
+
+// enqueue queue a finished spool file for upload, unless the uploader was drained
+func (upl *spoolUploader) enqueue(base string) error {
+	upl.mutex.Lock()
+	defer upl.mutex.Unlock()
+	if upl.drained {
+		return errSpoolDrained
+	}
+	upl.queue <- base
+	return nil
+}
+
+func (upl *spoolUploader) drain() {
+	upl.recovering.Wait()
+	upl.mutex.Lock()
+	if !upl.drained {
+		upl.drained = true
+		close(upl.queue)
+	}
+	upl.mutex.Unlock()
+	upl.done.Wait()
+}
+
+func (upl *spoolUploader) run() {
+	defer upl.done.Done()
+	for base := range upl.queue {
+		if err := upl.upload(base); err != nil {
+			upl.giveUp(base, err)
+		}
+	}
+}
+
+// giveUp move the files of a spool file we couldn't upload to the dead-letter directory, or else leave them to be
+// tried again on the next start
+func (upl *spoolUploader) giveUp(base string, err error) {
+	event := logger.Error().Str("spool", base).Int("attempts", upl.policy.attempts).Err(err)
+	if upl.deadLetterDir == "" {
+		event.Msg("giving up on upload; the spool file will be tried again on the next start")
+		return
+	}
+
+	dlbase := filepath.Join(upl.deadLetterDir, filepath.Base(base))
+	dlerr := os.MkdirAll(upl.deadLetterDir, 0o700)
+	if dlerr == nil {
+		dlerr = os.Rename(base+".spool", dlbase+".data")
+	}
+	if dlerr == nil {
+		dlerr = os.Rename(base+".json", dlbase+".json")
+	}
+	if dlerr != nil {
+		event.AnErr("deadLetterError", dlerr).Msg("giving up on upload; the spool file will be tried again on the next start")
+		return
+	}
+	event.Str("deadLetter", dlbase+".data").Msg("giving up on upload")
+}
+
+// upload copy one spool file to its object (retrying as needed), then delete it
+func (upl *spoolUploader) upload(base string) error {
+	text, err := os.ReadFile(base + ".json")
+	if err != nil {
+		return err
+	}
+	var meta spoolMeta
+	if err := json.Unmarshal(text, &meta); err != nil {
+		return fmt.Errorf("spool sidecar %s.json is unreadable: %w", base, err)
+	}
+
+	data, err := os.Open(base + ".spool")
+	if os.IsNotExist(err) {
+		// the data was uploaded and deleted, but we stopped before deleting the sidecar
+		return os.Remove(base + ".json")
+	} else if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	object := meta.url()
+	if meta.EncryptionKeySHA256 != "" {
+		meta.EncryptionKey = upl.encryptionKey
+		if meta.encryptionKeySHA256() != meta.EncryptionKeySHA256 {
+			return fmt.Errorf("%s needs an encryption key other than the one configured", object)
+		}
+	}
+	if !meta.Complete {
+		logger.Warn().Str("object", object).Msg("uploading an incomplete spool file; the object may be truncated")
+	}
+
+	err = upl.policy.run(context.Background(), &meta, func() error {
+		if _, err := data.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return uploadObject(context.Background(), upl.client, &meta, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info().Str("object", object).Msg("uploaded from spool")
+
+	if err := os.Remove(base + ".spool"); err != nil {
+		return err
+	}
+	return os.Remove(base + ".json")
+}
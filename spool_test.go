@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aerospike-managed-cloud-services/flb-output-gcs/envelope"
+)
+
+// Test_spoolClient are objects written to a local file first, then uploaded and deleted when committed?
+func Test_spoolClient(t *testing.T) {
+	dir := t.TempDir()
+	cli := &storageClientForTest{}
+	spc, err := NewSpoolClient(dir, cli, noWaitRetryPolicy(0), "")
+	if err != nil {
+		t.Fatalf("NewSpoolClient() returned %s", err)
+	}
+
+	work1 := newWork1()
+	work1.Put(spc, *bytes.NewBufferString("abz"))
+
+	spooled, _ := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if len(spooled) != 1 {
+		t.Fatalf("wanted 1 spool file before commit, found %v", spooled)
+	}
+	if len(cli.objects) != 0 {
+		t.Errorf("objects were uploaded before commit: %v", cli.objects)
+	}
+
+	objectPath := work1.objectPath
+	work1.Commit()
+	spc.Drain()
+
+	wri := cli.objects["woopsie.example.com/"+objectPath]
+	if wri == nil {
+		t.Fatalf("%s was not uploaded; objects: %v", objectPath, cli.objects)
+	}
+	if wri.attrs.ContentEncoding != "gzip" || wri.buf.Len() != int(work1.Written) {
+		t.Errorf("uploaded object has Content-Encoding '%s' and %d bytes, wanted gzip and %d", wri.attrs.ContentEncoding, wri.buf.Len(), work1.Written)
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Errorf("spool files were left after upload: %v", left)
+	}
+}
+
+// Test_spoolClient_Recover do we upload the spool files left by a previous run, finished or not?
+func Test_spoolClient_Recover(t *testing.T) {
+	dir := t.TempDir()
+	writeSpoolMeta(filepath.Join(dir, "a.json"), &spoolMeta{Bucket: "b", ObjectPath: "finished", Complete: true})
+	os.WriteFile(filepath.Join(dir, "a.spool"), []byte("hello"), 0o600)
+	writeSpoolMeta(filepath.Join(dir, "b.json"), &spoolMeta{Bucket: "b", ObjectPath: "crashed", objectAttrs: objectAttrs{ContentType: "text/csv"}})
+	os.WriteFile(filepath.Join(dir, "b.spool"), []byte("hel"), 0o600)
+	// the data was already uploaded, only the sidecar is left
+	writeSpoolMeta(filepath.Join(dir, "c.json"), &spoolMeta{Bucket: "b", ObjectPath: "uploaded", Complete: true})
+
+	cli := &storageClientForTest{}
+	spc, _ := NewSpoolClient(dir, cli, noWaitRetryPolicy(0), "")
+	if err := spc.Recover(); err != nil {
+		t.Fatalf("Recover() returned %s", err)
+	}
+	spc.Drain()
+
+	if got := cli.objects["b/finished"]; got == nil || got.buf.String() != "hello" {
+		t.Errorf("b/finished was not uploaded: %#v", got)
+	}
+	if got := cli.objects["b/crashed"]; got == nil || got.buf.String() != "hel" || got.attrs.ContentType != "text/csv" {
+		t.Errorf("b/crashed was not uploaded: %#v", got)
+	}
+	if _, ok := cli.objects["b/uploaded"]; ok {
+		t.Error("b/uploaded was uploaded again")
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Errorf("spool files were left after recovery: %v", left)
+	}
+}
+
+// Test_spoolClient_Recover_many does Recover return at once, with more spool files left than the queue holds and an
+// upload that hangs, and are they all uploaded later?
+func Test_spoolClient_Recover_many(t *testing.T) {
+	dir := t.TempDir()
+	files := 1100
+	for i := 0; i < files; i++ {
+		base := filepath.Join(dir, fmt.Sprintf("f%d", i))
+		writeSpoolMeta(base+".json", &spoolMeta{Bucket: "b", ObjectPath: fmt.Sprintf("obj%d", i), Complete: true})
+		os.WriteFile(base+".spool", []byte("hello"), 0o600)
+	}
+
+	cli := &storageClientForTest{closeWait: make(chan struct{})}
+	spc, _ := NewSpoolClient(dir, cli, noWaitRetryPolicy(0), "")
+	recovered := make(chan error)
+	go func() { recovered <- spc.Recover() }()
+	select {
+	case err := <-recovered:
+		if err != nil {
+			t.Fatalf("Recover() returned %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Recover() is blocked by the queue")
+	}
+
+	close(cli.closeWait)
+	spc.Drain()
+	if len(cli.objects) != files {
+		t.Errorf("%d objects uploaded, wanted %d", len(cli.objects), files)
+	}
+}
+
+// Test_spoolClient_crash does the spool file of an object that was never committed hold every put, compressed and
+// encrypted, so that it can be recovered by the next run?
+func Test_spoolClient_crash(t *testing.T) {
+	dir := t.TempDir()
+	kek := bytes.Repeat([]byte{3}, envelope.KeySize)
+	spc, _ := NewSpoolClient(dir, &storageClientForTest{}, noWaitRetryPolicy(0), "")
+
+	work1 := newWork1()
+	work1.clock = newClockForTest()
+	work1.encryptKey = kek
+	work1.flushPuts = true
+	for _, line := range []string{"first\n", "second\n"} {
+		if err := work1.Put(spc, *bytes.NewBufferString(line)); err != nil {
+			t.Fatalf("Put() returned %s", err)
+		}
+	}
+	objectPath := work1.objectPath
+	// the process dies here: work1 is never committed, and its spool files are recovered by the next run
+
+	cli := &storageClientForTest{}
+	next, _ := NewSpoolClient(dir, cli, noWaitRetryPolicy(0), "")
+	if err := next.Recover(); err != nil {
+		t.Fatalf("Recover() returned %s", err)
+	}
+	next.Drain()
+
+	wri := cli.objects["woopsie.example.com/"+objectPath]
+	if wri == nil {
+		t.Fatalf("%s was not recovered; objects: %v", objectPath, cli.objects)
+	}
+	plain, err := envelope.NewReader(bytes.NewReader(wri.buf.Bytes()), kek)
+	if err != nil {
+		t.Fatalf("envelope.NewReader() %s", err)
+	}
+	compressed, err := io.ReadAll(plain)
+	if !errors.Is(err, envelope.ErrTruncated) {
+		t.Errorf("the envelope of an uncommitted object read to its end: %v", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("gzip.NewReader() %s", err)
+	}
+	text, _ := io.ReadAll(gz)
+	if string(text) != "first\nsecond\n" {
+		t.Errorf("recovered '%s', wanted both puts", text)
+	}
+}
+
+// Test_spoolClient_encryption is the key of an object kept out of its spool sidecar, and given back for the upload
+// only when it is the same key?
+func Test_spoolClient_encryption(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	cli := &storageClientForTest{}
+	spc, _ := NewSpoolClient(dir, cli, noWaitRetryPolicy(0), "")
+	spc.SetEncryptionKey(key)
+
+	w := spc.NewWriterFromBucketObjectPath("b", "obj", objectAttrs{EncryptionKey: key, KMSKeyName: "k"}, context.Background())
+	w.Write([]byte("secret"))
+	if text, _ := os.ReadFile(filepath.Join(dir, filepath.Base(w.(*spoolWriter).base)+".json")); bytes.Contains(text, []byte(base64.StdEncoding.EncodeToString(key))) {
+		t.Errorf("the key was written to the sidecar: %s", text)
+	}
+	w.Close()
+
+	// left by a run that had another key
+	other := objectAttrs{EncryptionKey: bytes.Repeat([]byte{2}, 32)}
+	writeSpoolMeta(filepath.Join(dir, "x.json"), &spoolMeta{Bucket: "b", ObjectPath: "other", EncryptionKeySHA256: other.encryptionKeySHA256(), Complete: true})
+	os.WriteFile(filepath.Join(dir, "x.spool"), []byte("hello"), 0o600)
+	spc.Recover()
+	spc.Drain()
+
+	if got := cli.objects["b/obj"]; got == nil || !bytes.Equal(got.attrs.EncryptionKey, key) || got.attrs.KMSKeyName != "k" {
+		t.Errorf("b/obj was not uploaded with its key: %#v", got)
+	}
+	if _, ok := cli.objects["b/other"]; ok {
+		t.Error("b/other was uploaded without its key")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x.spool")); err != nil {
+		t.Errorf("the spool file needing another key was not kept: %s", err)
+	}
+}
+
+// Test_spoolWriter_sync is a spool file synced once spoolSyncBytes were written to it, rather than on every write?
+func Test_spoolWriter_sync(t *testing.T) {
+	spc, _ := NewSpoolClient(t.TempDir(), &storageClientForTest{}, noWaitRetryPolicy(0), "")
+	w := spc.NewWriterFromBucketObjectPath("b", "obj", objectAttrs{}, context.Background()).(*spoolWriter)
+
+	w.Write([]byte("small"))
+	w.Write([]byte("writes"))
+	if w.unsynced != int64(len("smallwrites")) {
+		t.Errorf("%d bytes unsynced after small writes", w.unsynced)
+	}
+	w.Write(make([]byte, spoolSyncBytes))
+	if w.unsynced != 0 {
+		t.Errorf("%d bytes unsynced after spoolSyncBytes", w.unsynced)
+	}
+	w.Write([]byte("last"))
+	if err := w.Close(); err != nil || w.unsynced != 0 {
+		t.Errorf("Close() returned %v, with %d bytes unsynced", err, w.unsynced)
+	}
+	spc.Drain()
+}
+
+// Test_spoolWriter_afterDrain does an object committed after the uploader was drained at exit stay in the spool,
+// rather than panic?
+func Test_spoolWriter_afterDrain(t *testing.T) {
+	dir := t.TempDir()
+	spc, _ := NewSpoolClient(dir, &storageClientForTest{}, noWaitRetryPolicy(0), "")
+	w := spc.NewWriterFromBucketObjectPath("b", "late", objectAttrs{}, context.Background())
+	w.Write([]byte("late"))
+	spc.Drain()
+
+	if err := w.Close(); !errors.Is(err, errSpoolDrained) {
+		t.Errorf("Close() after Drain() returned %v", err)
+	}
+	if pending := spc.Pending(); len(pending) != 1 || pending[0].object != "gs://b/late" {
+		t.Errorf("pending %v, wanted the late object", pending)
+	}
+}
+
+// Test_spoolWriter_empty does committing an object with no data still produce an (empty) object?
+func Test_spoolWriter_empty(t *testing.T) {
+	cli := &storageClientForTest{}
+	spc, _ := NewSpoolClient(t.TempDir(), cli, noWaitRetryPolicy(0), "")
+
+	w := spc.NewWriterFromBucketObjectPath("b", "empty", objectAttrs{}, context.Background())
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned %s", err)
+	}
+	spc.Drain()
+
+	if got := cli.objects["b/empty"]; got == nil || got.buf.Len() != 0 {
+		t.Errorf("b/empty was not uploaded empty: %#v", got)
+	}
+}
+
+// Test_spoolUploader_retry is a failed upload retried, and moved to the dead-letter directory when we give up?
+func Test_spoolUploader_retry(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		failures     int
+		uploaded     bool
+		deadLettered bool
+	}{
+		{name: "retried", failures: 2, uploaded: true},
+		{name: "given up", failures: 3, deadLettered: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, dldir := t.TempDir(), t.TempDir()
+			cli := &storageClientForTest{failures: tt.failures}
+			spc, _ := NewSpoolClient(dir, cli, noWaitRetryPolicy(2), dldir)
+
+			w := spc.NewWriterFromBucketObjectPath("b", "obj", objectAttrs{}, context.Background())
+			w.Write([]byte("hello"))
+			w.Close()
+			spc.Drain()
+
+			if got := cli.objects["b/obj"]; got.closeErr == nil != tt.uploaded {
+				t.Errorf("last upload attempt of b/obj failed with %v", got.closeErr)
+			}
+			if left, _ := os.ReadDir(dir); len(left) != 0 {
+				t.Errorf("spool files were left: %v", left)
+			}
+			dead, _ := filepath.Glob(filepath.Join(dldir, "*.data"))
+			if (len(dead) == 1) != tt.deadLettered {
+				t.Errorf("dead letters: %v", dead)
+			}
+		})
+	}
+}
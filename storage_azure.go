@@ -0,0 +1,133 @@
+// IStorageClient for Azure Blob Storage, writing block blobs
+
+package main //notest
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+type azureClient struct {
+	client *azblob.Client
+}
+
+// newAzureClient constructor; the bucket of each object is its container.
+//
+// Credentials come from the AZURE_STORAGE_CONNECTION_STRING environment
+// variable, or else AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY, or else a SAS
+// token in the endpoint URL. The endpoint defaults to the account's blob service.
+func newAzureClient(endpoint string) (*azureClient, error) {
+	var cli *azblob.Client
+	var err error
+
+	account, key := os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_KEY")
+	if endpoint == "" && account != "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", account)
+	}
+
+	switch {
+	case os.Getenv("AZURE_STORAGE_CONNECTION_STRING") != "":
+		cli, err = azblob.NewClientFromConnectionString(os.Getenv("AZURE_STORAGE_CONNECTION_STRING"), nil)
+	case account != "" && key != "":
+		var cred *azblob.SharedKeyCredential
+		if cred, err = azblob.NewSharedKeyCredential(account, key); err == nil {
+			cli, err = azblob.NewClientWithSharedKeyCredential(endpoint, cred, nil)
+		}
+	case endpoint != "":
+		cli, err = azblob.NewClientWithNoCredential(endpoint, nil)
+	default:
+		err = fmt.Errorf("Backend azure needs an Endpoint, or AZURE_STORAGE_CONNECTION_STRING or AZURE_STORAGE_ACCOUNT to be set")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &azureClient{client: cli}, nil
+}
+
+// NewWriterFromBucketObjectPath stream the object as the blocks of a block blob
+//
+// The storage class is the blob's access tier (Hot, Cool, Cold or Archive). A
+// KMS key name is an encryption scope, and an encryption key is a
+// customer-provided key.
+func (azc *azureClient) NewWriterFromBucketObjectPath(bucket, path string, attrs objectAttrs, ctx context.Context) IStorageWriter {
+	return newPipeWriter(attrs, func(body io.Reader, pw *pipeWriter) error {
+		headers := &blob.HTTPHeaders{}
+		if pw.attrs.ContentEncoding != "" {
+			headers.BlobContentEncoding = &pw.attrs.ContentEncoding
+		}
+		if pw.attrs.ContentType != "" {
+			headers.BlobContentType = &pw.attrs.ContentType
+		}
+		if pw.attrs.CacheControl != "" {
+			headers.BlobCacheControl = &pw.attrs.CacheControl
+		}
+		opts := &azblob.UploadStreamOptions{
+			BlockSize:   int64(pw.chunkSize),
+			HTTPHeaders: headers,
+			Metadata:    azureMetadata(pw.attrs.Metadata),
+		}
+		cpk, scope := azureEncryption(pw.attrs)
+		opts.CPKInfo, opts.CPKScopeInfo = cpk, scope
+		if pw.attrs.StorageClass != "" {
+			tier := blob.AccessTier(pw.attrs.StorageClass)
+			opts.AccessTier = &tier
+		}
+		if _, err := azc.client.UploadStream(ctx, bucket, path, body, opts); err != nil {
+			return err
+		}
+
+		// the blob is committed; the commit metadata is set on it afterwards
+		if len(pw.commitMetadata) > 0 {
+			metadata := pw.attrs.withMetadata(pw.commitMetadata).Metadata
+			blobClient := azc.client.ServiceClient().NewContainerClient(bucket).NewBlobClient(path)
+			setOpts := &blob.SetMetadataOptions{CPKInfo: cpk, CPKScopeInfo: scope}
+			if _, err := blobClient.SetMetadata(ctx, azureMetadata(metadata), setOpts); err != nil {
+				logger.Warn().Str("object", path).Err(err).Msg("object metadata could not be updated")
+			}
+		}
+		return nil
+	})
+}
+
+func (azc *azureClient) CheckBucket(ctx context.Context, bucket string) error {
+	_, err := azc.client.ServiceClient().NewContainerClient(bucket).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+		return fmt.Errorf("container %s does not exist", bucket)
+	}
+	return nil
+}
+
+// azureEncryption the customer-provided key or encryption scope of a blob; nil for the account's default
+func azureEncryption(attrs objectAttrs) (*blob.CPKInfo, *blob.CPKScopeInfo) {
+	if attrs.EncryptionKey != nil {
+		key := base64.StdEncoding.EncodeToString(attrs.EncryptionKey)
+		hash := attrs.encryptionKeySHA256()
+		algorithm := blob.EncryptionAlgorithmTypeAES256
+		return &blob.CPKInfo{EncryptionKey: &key, EncryptionKeySHA256: &hash, EncryptionAlgorithm: &algorithm}, nil
+	}
+	if attrs.KMSKeyName != "" {
+		scope := attrs.KMSKeyName
+		return nil, &blob.CPKScopeInfo{EncryptionScope: &scope}
+	}
+	return nil, nil
+}
+
+// azureMetadata metadata as the azure sdk takes it
+func azureMetadata(metadata map[string]string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	ret := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		v := v
+		ret[k] = &v
+	}
+	return ret
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// localClient an IStorageClient that writes each object to a file under dir, as <dir>/<bucket>/<path>.
+// Files have no attributes, so those are dropped.
+type localClient struct {
+	dir string
+}
+
+// newLocalClient constructor
+func newLocalClient(dir string) (*localClient, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("Backend local needs a LocalDir")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &localClient{dir: dir}, nil
+}
+
+func (loc *localClient) NewWriterFromBucketObjectPath(bucket, path string, attrs objectAttrs, ctx context.Context) IStorageWriter {
+	dest := filepath.Join(loc.dir, bucket, filepath.FromSlash(path))
+	if rel, err := filepath.Rel(loc.dir, dest); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return &localWriter{err: fmt.Errorf("object %s/%s is outside of LocalDir", bucket, path)}
+	}
+	return &localWriter{path: dest}
+}
+
+// localWriter an IStorageWriter for a file. The object is written to a temporary file, which is renamed to the
+// object's path on Close, so a reader never sees a partial object.
+type localWriter struct {
+	path string
+	file *os.File
+	err  error
+}
+
+// SetChunkSize there are no chunks in a file
+func (lw *localWriter) SetChunkSize(n int) {
+}
+
+// SetCommitMetadata a file has no metadata
+func (lw *localWriter) SetCommitMetadata(metadata map[string]string) {
+}
+
+// open create the temporary file (and the directories of the path) on the first write
+func (lw *localWriter) open() error {
+	if lw.err != nil || lw.file != nil {
+		return lw.err
+	}
+	if lw.err = os.MkdirAll(filepath.Dir(lw.path), 0o755); lw.err != nil {
+		return lw.err
+	}
+	lw.file, lw.err = os.Create(fmt.Sprintf("%s.%s.tmp", lw.path, uuid.New()))
+	return lw.err
+}
+
+func (lw *localWriter) Write(p []byte) (int, error) {
+	if err := lw.open(); err != nil {
+		return 0, err
+	}
+	return lw.file.Write(p)
+}
+
+// Abort remove the temporary file
+func (lw *localWriter) Abort() {
+	if lw.file != nil {
+		lw.file.Close()
+		os.Remove(lw.file.Name())
+	}
+	lw.err = errAborted
+}
+
+// Close finish the file and move it into place
+func (lw *localWriter) Close() error {
+	if err := lw.open(); err != nil {
+		return err
+	}
+	tmp := lw.file.Name()
+	if err := lw.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, lw.path)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test_localClient does an ObjectWorker write the same objects to the local backend as to a bucket?
+func Test_localClient(t *testing.T) {
+	dir := t.TempDir()
+	cli, err := (&storageAPIWrapper{}).NewClient(context.Background(), storageConfig{backend: BackendLocal, localDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	work1 := newWork1()
+	work1.Put(cli, *bytes.NewBufferString("abz"))
+	work1.Put(cli, *bytes.NewBufferString("xyz"))
+
+	// nothing is visible until the commit
+	if files, _ := filepath.Glob(filepath.Join(dir, "woopsie.example.com", "sipiyou", "*", "*", "*", "*.gz")); len(files) != 0 {
+		t.Errorf("objects were visible before the commit: %v", files)
+	}
+	work1.Commit()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "woopsie.example.com", "sipiyou", "*", "*", "*", "*"))
+	if len(files) != 1 || filepath.Ext(files[0]) != ".gz" {
+		t.Fatalf("wanted one .gz object, got %v", files)
+	}
+	f, _ := os.Open(files[0])
+	defer f.Close()
+	zreader, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bb, _ := io.ReadAll(zreader); !bytes.Equal(bb, []byte("abzxyz")) {
+		t.Errorf("object has '%s'", bb)
+	}
+}
+
+// Test_localClient_paths is an empty object still made, and are objects outside of the directory refused?
+func Test_localClient_paths(t *testing.T) {
+	if _, err := newLocalClient(""); err == nil {
+		t.Error("newLocalClient() without a directory should fail")
+	}
+
+	dir := t.TempDir()
+	cli, _ := newLocalClient(filepath.Join(dir, "root"))
+
+	empty := cli.NewWriterFromBucketObjectPath("b", "a/empty", objectAttrs{}, context.Background())
+	if err := empty.Close(); err != nil {
+		t.Errorf("Close() %s", err)
+	}
+	if st, err := os.Stat(filepath.Join(dir, "root", "b", "a", "empty")); err != nil || st.Size() != 0 {
+		t.Errorf("empty object: %v %v", st, err)
+	}
+
+	outside := cli.NewWriterFromBucketObjectPath("b", "../../escaped", objectAttrs{}, context.Background())
+	if _, err := outside.Write([]byte("x")); err == nil {
+		t.Error("Write() outside of the directory should fail")
+	}
+	if err := outside.Close(); err == nil {
+		t.Error("Close() outside of the directory should fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("an object was written outside of the directory (%v)", err)
+	}
+}
@@ -0,0 +1,98 @@
+// IStorageClient for S3-compatible object stores (AWS S3, MinIO, ...)
+
+package main //notest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// s3MinPartSize the smallest part of a multipart upload that S3 accepts (except for the last one)
+const s3MinPartSize = 5 * 1024 * 1024
+
+type s3Client struct {
+	client *minio.Client
+}
+
+// newS3Client constructor; endpoint is a URL like https://minio.example.com:9000, or blank for AWS.
+//
+// Credentials come from the usual AWS environment variables or credentials file,
+// or else from the instance's IAM role.
+func newS3Client(endpoint, region string) (*s3Client, error) {
+	host, secure := "s3.amazonaws.com", true
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			// no scheme, just host[:port]
+			host = endpoint
+		} else {
+			host, secure = u.Host, !strings.EqualFold(u.Scheme, "http")
+		}
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.EnvMinio{},
+		&credentials.IAM{},
+	})
+	cli, err := minio.New(host, &minio.Options{Creds: creds, Secure: secure, Region: region})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Client{client: cli}, nil
+}
+
+// NewWriterFromBucketObjectPath stream the object as a multipart upload
+//
+// The metadata of an S3 object can't be changed once the upload has begun, so
+// the commit metadata is left out. A KMS key name is an SSE-KMS key id, and an
+// encryption key is an SSE-C key.
+func (s3c *s3Client) NewWriterFromBucketObjectPath(bucket, path string, attrs objectAttrs, ctx context.Context) IStorageWriter {
+	return newPipeWriter(attrs, func(body io.Reader, pw *pipeWriter) error {
+		sse, err := s3Encryption(pw.attrs)
+		if err != nil {
+			return err
+		}
+		_, err = s3c.client.PutObject(ctx, bucket, path, body, -1, minio.PutObjectOptions{
+			ContentEncoding: pw.attrs.ContentEncoding,
+			ContentType:     pw.attrs.ContentType,
+			StorageClass:    pw.attrs.StorageClass,
+			CacheControl:    pw.attrs.CacheControl,
+			UserMetadata:    pw.attrs.Metadata,
+			PartSize:        uint64(max(pw.chunkSize, s3MinPartSize)),
+
+			ServerSideEncryption: sse,
+		})
+		return err
+	})
+}
+
+func (s3c *s3Client) CheckBucket(ctx context.Context, bucket string) error {
+	if exists, err := s3c.client.BucketExists(ctx, bucket); err == nil && !exists {
+		return fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	return nil
+}
+
+// s3Encryption the server-side encryption of an object, or nil for the bucket's default
+func s3Encryption(attrs objectAttrs) (encrypt.ServerSide, error) {
+	switch {
+	case attrs.EncryptionKey != nil:
+		return encrypt.NewSSEC(attrs.EncryptionKey)
+	case attrs.KMSKeyName != "":
+		return encrypt.NewSSEKMS(attrs.KMSKeyName, nil)
+	default:
+		return nil, nil
+	}
+}
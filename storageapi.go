@@ -4,26 +4,68 @@ package main //notest
 
 import (
 	"context"
+	"errors"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
 )
 
 type IStorageWriter interface {
 	Close() error
 	Write(p []byte) (n int, err error)
 	SetChunkSize(n int)
+
+	// SetCommitMetadata add metadata that is only known once the object is complete; called just before Close
+	SetCommitMetadata(metadata map[string]string)
+
+	// Abort give up on the object instead of closing it, so that none of it is committed
+	Abort()
 }
 
+// errAborted the error of an upload that was given up on
+var errAborted = errors.New("object was aborted")
+
 type storageWriter struct {
-	writer *storage.Writer
+	writer         *storage.Writer
+	object         *storage.ObjectHandle
+	ctx            context.Context
+	cancel         context.CancelFunc
+	metadata       map[string]string
+	commitMetadata map[string]string
 }
 
 func (stoc *storageWriter) SetChunkSize(n int) {
 	stoc.writer.ChunkSize = n
 }
 
+func (stoc *storageWriter) SetCommitMetadata(metadata map[string]string) {
+	stoc.commitMetadata = metadata
+}
+
+// Close commit the object, then patch the commit metadata onto it
+//
+// The upload began long before the commit metadata was known. The object is
+// committed even if the patch fails, so that is only logged.
 func (stoc *storageWriter) Close() error {
-	return stoc.writer.Close()
+	defer stoc.cancel()
+	if err := stoc.writer.Close(); err != nil {
+		return err
+	}
+	if len(stoc.commitMetadata) == 0 {
+		return nil
+	}
+	metadata := objectAttrs{Metadata: stoc.metadata}.withMetadata(stoc.commitMetadata).Metadata
+	if _, err := stoc.object.Update(stoc.ctx, storage.ObjectAttrsToUpdate{Metadata: metadata}); err != nil {
+		logger.Warn().Str("object", stoc.writer.Name).Err(err).Msg("object metadata could not be updated")
+	}
+	return nil
+}
+
+// Abort cancel the upload; an object isn't created until its upload is closed
+func (stoc *storageWriter) Abort() {
+	stoc.cancel()
+	stoc.writer.Close()
 }
 
 func (stoc *storageWriter) Write(p []byte) (n int, err error) {
@@ -31,32 +73,156 @@ func (stoc *storageWriter) Write(p []byte) (n int, err error) {
 }
 
 type IStorageClient interface {
-	NewWriterFromBucketObjectPath(bucket, path string, ctx context.Context) IStorageWriter
+	NewWriterFromBucketObjectPath(bucket, path string, attrs objectAttrs, ctx context.Context) IStorageWriter
+}
+
+// IBucketChecker a storage client that can tell whether a bucket exists, before the first object is written to it
+//
+// Only a bucket known not to exist is an error: when the bucket can't be
+// looked at (e.g. the credentials may write objects, but not read the bucket),
+// it is assumed to be fine, and its uploads fail if it isn't.
+type IBucketChecker interface {
+	CheckBucket(ctx context.Context, bucket string) error
+}
+
+// checkBucket check a bucket with the client, when it can
+func checkBucket(ctx context.Context, client IStorageClient, bucket string) error {
+	if chk, ok := client.(IBucketChecker); ok {
+		return chk.CheckBucket(ctx, bucket)
+	}
+	return nil
 }
 
 type storageClient struct {
 	client *storage.Client
 }
 
-func (stoc *storageClient) NewWriterFromBucketObjectPath(bucket, path string, ctx context.Context) IStorageWriter {
-	writer := stoc.client.Bucket(bucket).Object(path).NewWriter(ctx)
-	ret := &storageWriter{writer}
+func (stoc *storageClient) NewWriterFromBucketObjectPath(bucket, path string, attrs objectAttrs, ctx context.Context) IStorageWriter {
+	object := stoc.client.Bucket(bucket).Object(path)
+	if attrs.EncryptionKey != nil {
+		// the key goes with every request on this handle, so also with the metadata patch in Close
+		object = object.Key(attrs.EncryptionKey)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	writer := object.NewWriter(ctx)
+	writer.ContentType = attrs.ContentType
+	writer.ContentEncoding = attrs.ContentEncoding
+	writer.StorageClass = attrs.StorageClass
+	writer.CacheControl = attrs.CacheControl
+	writer.Metadata = attrs.Metadata
+	writer.KMSKeyName = attrs.KMSKeyName
+	ret := &storageWriter{writer: writer, object: object, ctx: ctx, cancel: cancel, metadata: attrs.Metadata}
 	return ret
 }
 
+func (stoc *storageClient) CheckBucket(ctx context.Context, bucket string) error {
+	if _, err := stoc.client.Bucket(bucket).Attrs(ctx); errors.Is(err, storage.ErrBucketNotExist) {
+		return err
+	}
+	return nil
+}
+
+// StorageBackend the kind of object store objects are written to: gcs, s3, azure or local
+type StorageBackend string
+
+const (
+	BackendGCS   StorageBackend = "gcs"
+	BackendS3    StorageBackend = "s3"
+	BackendAzure StorageBackend = "azure"
+	BackendLocal StorageBackend = "local"
+)
+
+// storageConfig which backend a client connects to, and how
+type storageConfig struct {
+	backend StorageBackend
+
+	// URL of the storage service; blank for the usual one
+	endpoint string
+
+	// gcs service account key file, or the key itself; blank for the application default credentials
+	credentialsFile string
+	credentialsJSON string
+
+	// gcs service account to impersonate with the credentials above, through a chain of delegates (if any)
+	impersonate string
+	delegates   []string
+
+	// send gcs requests without credentials, e.g. to an emulator
+	noAuth bool
+
+	// gcs quota project
+	projectID string
+
+	// s3 region; blank to look it up
+	region string
+
+	// root directory of the local backend
+	localDir string
+}
+
 // IStorageAPI StorageAPI abstraction for test
 type IStorageAPI interface {
-	NewClient(ctx context.Context) (IStorageClient, error)
+	NewClient(ctx context.Context, cfg storageConfig) (IStorageClient, error)
 }
 
 // storageAPIWrapper concrete StorageAPI for production
 type storageAPIWrapper struct{}
 
-func (sapi *storageAPIWrapper) NewClient(ctx context.Context) (IStorageClient, error) {
+func (sapi *storageAPIWrapper) NewClient(ctx context.Context, cfg storageConfig) (IStorageClient, error) {
+	switch cfg.backend {
+	case BackendS3:
+		return newS3Client(cfg.endpoint, cfg.region)
+	case BackendAzure:
+		return newAzureClient(cfg.endpoint)
+	case BackendLocal:
+		return newLocalClient(cfg.localDir)
+	}
+
+	opts, err := gcsClientOptions(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	var cli *storage.Client
-	cli, err := storage.NewClient(ctx)
+	cli, err = storage.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return &storageClient{client: cli}, nil
 }
+
+// gcsClientOptions the endpoint and credentials of a gcs client for one output instance.
+// With none of them, the client finds its endpoint (or STORAGE_EMULATOR_HOST) and credentials as usual.
+func gcsClientOptions(ctx context.Context, cfg storageConfig) ([]option.ClientOption, error) {
+	opts := []option.ClientOption{}
+	if cfg.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.endpoint))
+	}
+	if cfg.projectID != "" {
+		opts = append(opts, option.WithQuotaProject(cfg.projectID))
+	}
+	if cfg.noAuth {
+		return append(opts, option.WithoutAuthentication()), nil
+	}
+
+	creds := []option.ClientOption{}
+	if cfg.credentialsJSON != "" {
+		creds = append(creds, option.WithCredentialsJSON([]byte(cfg.credentialsJSON)))
+	} else if cfg.credentialsFile != "" {
+		creds = append(creds, option.WithCredentialsFile(cfg.credentialsFile))
+	}
+	if cfg.impersonate == "" {
+		return append(opts, creds...), nil
+	}
+
+	// the credentials above only sign the requests for tokens of the impersonated account
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: cfg.impersonate,
+		Scopes:          []string{storage.ScopeReadWrite},
+		Delegates:       cfg.delegates,
+	}, creds...)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, option.WithTokenSource(ts)), nil
+}
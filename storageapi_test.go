@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// Test_gcsClientOptions does each output's config make its own endpoint and credential options?
+func Test_gcsClientOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     storageConfig
+		want    int
+		wantErr bool
+	}{
+		{name: "defaults", cfg: storageConfig{}, want: 0},
+		{name: "emulator", cfg: storageConfig{endpoint: "http://localhost:4443/storage/v1/", projectID: "p", noAuth: true, credentialsFile: "/etc/sa.json"}, want: 3},
+		{name: "credentials json", cfg: storageConfig{credentialsJSON: "{}", credentialsFile: "/etc/sa.json"}, want: 1},
+		{name: "impersonate with bad credentials", cfg: storageConfig{credentialsJSON: "not json", impersonate: "writer@p.iam.gserviceaccount.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := gcsClientOptions(context.Background(), tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gcsClientOptions() error %v", err)
+			}
+			if len(opts) != tt.want {
+				t.Errorf("gcsClientOptions() made %d options, wanted %d", len(opts), tt.want)
+			}
+		})
+	}
+}
@@ -5,6 +5,12 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
@@ -13,30 +19,198 @@ import (
 // google storage
 
 type storageWriterForTest struct {
-	buf *bytes.Buffer
+	buf            *bytes.Buffer
+	closeErr       error
+	attrs          objectAttrs
+	commitMetadata map[string]string
+
+	// the context the writer was made with, as the real clients' upload spans would see it
+	ctx context.Context
+
+	// when set, Close waits until it's closed, like an upload that hangs
+	closeWait chan struct{}
+
+	// true once the object was aborted
+	aborted bool
+
+	// when set, every Write fails with it
+	writeErr error
+}
+
+func (sto *storageWriterForTest) Abort() {
+	sto.aborted = true
 }
 
 func (sto *storageWriterForTest) Close() error {
-	return nil
+	if sto.closeWait != nil {
+		<-sto.closeWait
+	}
+	return sto.closeErr
 }
 
 func (sto *storageWriterForTest) Write(b []byte) (n int, err error) {
+	if sto.writeErr != nil {
+		return 0, sto.writeErr
+	}
 	return sto.buf.Write(b)
 }
 
 func (sto *storageWriterForTest) SetChunkSize(n int) {
 }
 
+func (sto *storageWriterForTest) SetCommitMetadata(metadata map[string]string) {
+	sto.commitMetadata = metadata
+}
+
+// storageClientForTest keeps every writer it made, by "bucket/path", so tests can look at the objects.
+// The first `failures` writers it makes fail to Close, and the Close of each waits for closeWait, when it's set.
+// The writers of the objects in failWrites fail to Write
 type storageClientForTest struct {
+	mutex      sync.Mutex
+	objects    map[string]*storageWriterForTest
+	failures   int
+	closeWait  chan struct{}
+	failWrites map[string]bool
+
+	// buckets that don't exist, and the number of times each bucket was checked
+	missing map[string]bool
+	checks  map[string]int
+}
+
+func (sto *storageClientForTest) CheckBucket(ctx context.Context, bucket string) error {
+	sto.mutex.Lock()
+	defer sto.mutex.Unlock()
+	if sto.checks == nil {
+		sto.checks = map[string]int{}
+	}
+	sto.checks[bucket]++
+	if sto.missing[bucket] {
+		return errors.New("bucket does not exist")
+	}
+	return nil
+}
+
+func (sto *storageClientForTest) NewWriterFromBucketObjectPath(bucket, path string, attrs objectAttrs, ctx context.Context) IStorageWriter {
+	sto.mutex.Lock()
+	defer sto.mutex.Unlock()
+	if sto.objects == nil {
+		sto.objects = map[string]*storageWriterForTest{}
+	}
+	wri := &storageWriterForTest{buf: bytes.NewBuffer([]byte{}), attrs: attrs, ctx: ctx, closeWait: sto.closeWait}
+	if sto.failures > 0 {
+		sto.failures--
+		wri.closeErr = errors.New("injected failure")
+	}
+	if sto.failWrites[bucket+"/"+path] {
+		wri.writeErr = errors.New("injected write failure")
+	}
+	sto.objects[bucket+"/"+path] = wri
+	return wri
+}
+
+// objectEncoderForTest an object-buffering format that keeps its records as lines, and can fail to write them
+type objectEncoderForTest struct {
+	buf       bytes.Buffer
+	failWrite bool
+}
+
+func (enc *objectEncoderForTest) NewObjectEncoder() IObjectEncoder {
+	return &objectEncoderForTest{failWrite: enc.failWrite}
+}
+
+func (enc *objectEncoderForTest) FileExtension() string {
+	return ""
+}
+
+func (enc *objectEncoderForTest) AddRecord(tag string, timestamp float64, fields logFields) error {
+	enc.buf.WriteString(tag + "\n")
+	return nil
+}
+
+func (enc *objectEncoderForTest) Size() int64 {
+	return int64(enc.buf.Len())
+}
+
+func (enc *objectEncoderForTest) WriteTo(w io.Writer) (int64, error) {
+	if enc.failWrite {
+		return 0, errors.New("injected failure")
+	}
+	return enc.buf.WriteTo(w)
+}
+
+// clockForTest a clock that only moves when a test calls Advance, which fires the timers that came due
+type clockForTest struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*timerForTest
+}
+
+type timerForTest struct {
+	clock   *clockForTest
+	at      time.Time
+	f       func()
+	stopped bool
 }
 
-func (sto *storageClientForTest) NewWriterFromBucketObjectPath(bucket, path string, ctx context.Context) IStorageWriter {
-	return &storageWriterForTest{buf: bytes.NewBuffer([]byte{})}
+func newClockForTest() *clockForTest {
+	return &clockForTest{now: time.Date(2024, 3, 9, 10, 20, 30, 0, time.UTC)}
 }
 
-type storageAPIForTest struct{}
+func (clk *clockForTest) Now() time.Time {
+	clk.mutex.Lock()
+	defer clk.mutex.Unlock()
+	return clk.now
+}
+
+func (clk *clockForTest) AfterFunc(d time.Duration, f func()) clockTimer {
+	clk.mutex.Lock()
+	defer clk.mutex.Unlock()
+	timer := &timerForTest{clock: clk, at: clk.now.Add(d), f: f}
+	clk.timers = append(clk.timers, timer)
+	return timer
+}
 
-func (sapi *storageAPIForTest) NewClient(ctx context.Context) (IStorageClient, error) {
+// Advance move the clock forward by d, and call the functions of the timers that came due, in order. Unlike
+// time.AfterFunc, each is called on the caller's goroutine, so a timer's command has reached its worker by the
+// time Advance returns
+func (clk *clockForTest) Advance(d time.Duration) {
+	clk.mutex.Lock()
+	clk.now = clk.now.Add(d)
+	var due, pending []*timerForTest
+	for _, timer := range clk.timers {
+		switch {
+		case timer.stopped:
+		case !timer.at.After(clk.now):
+			timer.stopped = true
+			due = append(due, timer)
+		default:
+			pending = append(pending, timer)
+		}
+	}
+	clk.timers = pending
+	clk.mutex.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, timer := range due {
+		timer.f()
+	}
+}
+
+func (timer *timerForTest) Stop() bool {
+	timer.clock.mutex.Lock()
+	defer timer.clock.mutex.Unlock()
+	fired := timer.stopped
+	timer.stopped = true
+	return !fired
+}
+
+type storageAPIForTest struct {
+	// the config of the last client made
+	cfg storageConfig
+}
+
+func (sapi *storageAPIForTest) NewClient(ctx context.Context, cfg storageConfig) (IStorageClient, error) {
+	sapi.cfg = cfg
 	return &storageClientForTest{}, nil
 }
 
@@ -69,6 +243,11 @@ func (opc *flbOutputAPIForTest) FLBPluginGetContext(proxyContext unsafe.Pointer)
 	return opc.ctx
 }
 
+// stateForTest the output instance registered by FLBPluginInit with the plugin's context
+func stateForTest(plugin unsafe.Pointer) *outputState {
+	return lookupInstance(flbAPI.FLBPluginGetContext(plugin).(string))
+}
+
 func (opc *flbOutputAPIForTest) FLBPluginUnregister(plugin unsafe.Pointer) {}
 
 func (opc *flbOutputAPIForTest) NewDecoder(data unsafe.Pointer, length int) *output.FLBDecoder {
@@ -78,3 +257,27 @@ func (opc *flbOutputAPIForTest) NewDecoder(data unsafe.Pointer, length int) *out
 func (opc *flbOutputAPIForTest) GetRecord(dec *output.FLBDecoder) (int, interface{}, map[interface{}]interface{}) {
 	return output.GetRecord(dec)
 }
+
+// chunkForTest a msgpack chunk of records as fluent-bit sends them, each a [timestamp, fields] pair of short strings
+func chunkForTest(records ...map[string]string) []byte {
+	str := func(b []byte, s string) []byte {
+		return append(append(b, 0xa0|byte(len(s))), s...)
+	}
+	var chunk []byte
+	for i, fields := range records {
+		// [ext 0 (seconds, nanoseconds), {fields}]
+		chunk = append(chunk, 0x92, 0xd7, 0x00)
+		chunk = binary.BigEndian.AppendUint32(chunk, uint32(1710000000+i))
+		chunk = binary.BigEndian.AppendUint32(chunk, 0)
+		chunk = append(chunk, 0x80|byte(len(fields)))
+		var keys []string
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			chunk = str(str(chunk, key), fields[key])
+		}
+	}
+	return chunk
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	promBridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer of the plugin's own spans. Until an exporter is set up (or without one) the global provider is a no-op,
+// and spans cost next to nothing
+var tracer = otel.Tracer("github.com/aerospike-managed-cloud-services/flb-output-gcs")
+
+// span attribute keys
+const (
+	attrOutputID = attribute.Key("flb.output_id")
+	attrTag      = attribute.Key("flb.tag")
+	attrObject   = attribute.Key("gcs.object")
+	attrBytes    = attribute.Key("flb.bytes")
+	attrRecords  = attribute.Key("flb.records")
+)
+
+// TelemetryExporter where spans and metrics are exported: nowhere (none), or to an OTLP collector (otlp)
+type TelemetryExporter string
+
+const (
+	ExporterNone TelemetryExporter = "none"
+	ExporterOTLP TelemetryExporter = "otlp"
+)
+
+// the providers of the process, set up by the first output instance with an exporter
+var (
+	telemetryMutex    sync.Mutex
+	telemetryShutdown []func(context.Context) error
+)
+
+// startTelemetry export spans, and the metrics of the metrics registry, over OTLP/HTTP to endpoint (a URL like
+// http://collector:4318), or else to where the usual OTEL_EXPORTER_OTLP_* environment variables say.
+// Only the first call does anything
+func startTelemetry(ctx context.Context, endpoint string) error {
+	telemetryMutex.Lock()
+	defer telemetryMutex.Unlock()
+	if telemetryShutdown != nil {
+		return nil
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "fluent-bit")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return err
+	}
+
+	var traceOpts []otlptracehttp.Option
+	var metricOpts []otlpmetrichttp.Option
+	if endpoint = strings.TrimSuffix(endpoint, "/"); endpoint != "" {
+		traceOpts = append(traceOpts, otlptracehttp.WithEndpointURL(endpoint+"/v1/traces"))
+		metricOpts = append(metricOpts, otlpmetrichttp.WithEndpointURL(endpoint+"/v1/metrics"))
+	}
+	spanExporter, err := otlptracehttp.New(ctx, traceOpts...)
+	if err != nil {
+		return err
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx, metricOpts...)
+	if err != nil {
+		return err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	producer := promBridge.NewMetricProducer(promBridge.WithGatherer(metrics.registry))
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithProducer(producer))),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	telemetryShutdown = []func(context.Context) error{tp.Shutdown, mp.Shutdown}
+	return nil
+}
+
+// stopTelemetry export what's left, and stop the exporters
+func stopTelemetry() {
+	telemetryMutex.Lock()
+	defer telemetryMutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var errs []error
+	for _, shutdown := range telemetryShutdown {
+		errs = append(errs, shutdown(ctx))
+	}
+	if err := errors.Join(errs...); err != nil {
+		logger.Warn().Err(err).Msg("telemetry could not be exported at exit")
+	}
+	telemetryShutdown = nil
+}
+
+// endSpan record err (if any) on the span, and end it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
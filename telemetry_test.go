@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans export the plugin's spans to an in-process recorder. The global tracer provider can only take
+// over the plugin's tracer once, so every test shares the recorder
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+// endedSpans the spans named name with the tag
+func endedSpans(sr *tracetest.SpanRecorder, name, tag string) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range sr.Ended() {
+		if span.Name() != name {
+			continue
+		}
+		for _, kv := range span.Attributes() {
+			if kv.Key == attrTag && kv.Value.AsString() == tag {
+				spans = append(spans, span)
+			}
+		}
+	}
+	return spans
+}
+
+func spanInt(span sdktrace.ReadOnlySpan, key string) int64 {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.AsInt64()
+		}
+	}
+	return -1
+}
+
+// Test_flbPluginFlushCtxGo_spans is a flush traced, with its puts as children, and the object's own span
+// (the parent of the storage client's spans) linked from the put and the commit?
+func Test_flbPluginFlushCtxGo_spans(t *testing.T) {
+	sr := recordSpans()
+	cli := &storageClientForTest{}
+	state := outputState{
+		bucket:               "bucketymcbucketface.example.com",
+		bufferSizeKiB:        19,
+		bufferTimeoutSeconds: 300,
+		compression:          CompressionNone,
+		encoder:              NewRecordEncoder(FormatJSONLines, "ts", "tag"),
+		format:               FormatJSONLines,
+		gcsClient:            cli,
+		outputID:             "traced",
+		objectNameTemplate:   "{{ .InputTag }}/x",
+		tagKey:               "tag",
+		timeKey:              "ts",
+		workers:              map[string]*ObjectWorker{},
+	}
+
+	cbytePtr := goBytesToCBytes(memRecordForTest)
+	flbPluginFlushCtxGo(&state, cbytePtr, len(memRecordForTest), "traced-tag")
+	for _, work := range state.workers {
+		work.Close()
+	}
+
+	flushes := endedSpans(sr, "flbPluginFlushCtxGo", "traced-tag")
+	puts := endedSpans(sr, "ObjectWorker.Put", "traced-tag")
+	objects := endedSpans(sr, "ObjectWorker.object", "traced-tag")
+	commits := endedSpans(sr, "ObjectWorker.Commit", "traced-tag")
+	if len(flushes) != 1 || len(puts) != 1 || len(objects) != 1 || len(commits) != 1 {
+		t.Fatalf("wanted a span each, got %d flush, %d put, %d object and %d commit", len(flushes), len(puts), len(objects), len(commits))
+	}
+	flush, put, object, commit := flushes[0], puts[0], objects[0], commits[0]
+
+	if spanInt(flush, "flb.records") != 2 || spanInt(flush, "flb.bytes") != int64(len(memRecordForTest)) {
+		t.Errorf("flush span attributes %v", flush.Attributes())
+	}
+	if put.Parent().SpanID() != flush.SpanContext().SpanID() || object.Parent().SpanID() != put.SpanContext().SpanID() {
+		t.Error("the put span should be a child of the flush span, and the object span of the put span")
+	}
+
+	wri := cli.objects["bucketymcbucketface.example.com/traced-tag/x"]
+	if wri == nil || trace.SpanContextFromContext(wri.ctx).SpanID() != object.SpanContext().SpanID() {
+		t.Error("the storage client should get the object span's context")
+	}
+	if spanInt(commit, "flb.bytes") != int64(wri.buf.Len()) || spanInt(commit, "flb.records") != 2 {
+		t.Errorf("commit span attributes %v", commit.Attributes())
+	}
+	for _, span := range []sdktrace.ReadOnlySpan{put, commit} {
+		if links := span.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != object.SpanContext().SpanID() {
+			t.Errorf("%s should link to the object span, links %v", span.Name(), links)
+		}
+	}
+}
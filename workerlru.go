@@ -0,0 +1,57 @@
+package main
+
+import (
+	"container/list"
+	"time"
+)
+
+// workerLRU the keys of an instance's workers in order of use, the most recent first, with the time of each one's
+// last use
+type workerLRU struct {
+	order   *list.List // of *lruEntry
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	used time.Time
+}
+
+func newWorkerLRU() *workerLRU {
+	return &workerLRU{order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// touch record a use of the worker with key at now, making it the most recently used
+func (lru *workerLRU) touch(key string, now time.Time) {
+	if elem, ok := lru.entries[key]; ok {
+		elem.Value.(*lruEntry).used = now
+		lru.order.MoveToFront(elem)
+		return
+	}
+	lru.entries[key] = lru.order.PushFront(&lruEntry{key: key, used: now})
+}
+
+// remove forget the worker with key
+func (lru *workerLRU) remove(key string) {
+	if elem, ok := lru.entries[key]; ok {
+		lru.order.Remove(elem)
+		delete(lru.entries, key)
+	}
+}
+
+// walk call f with each worker and when it was used, from the least recently used, until f returns false. f may
+// remove the worker it's called with
+func (lru *workerLRU) walk(f func(key string, used time.Time) bool) {
+	for elem := lru.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		entry := elem.Value.(*lruEntry)
+		if !f(entry.key, entry.used) {
+			return
+		}
+		elem = prev
+	}
+}
+
+func (lru *workerLRU) len() int {
+	return lru.order.Len()
+}
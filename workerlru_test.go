@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// oldest the least recently used worker, and when it was used; false when there are none
+func (lru *workerLRU) oldest() (string, time.Time, bool) {
+	elem := lru.order.Back()
+	if elem == nil {
+		return "", time.Time{}, false
+	}
+	entry := elem.Value.(*lruEntry)
+	return entry.key, entry.used, true
+}
+
+// worker the worker for a tag and partition in Bucket, used once the way a flush uses it: pinned, and then unpinned,
+// which evicts the workers that are due to be
+func (state *outputState) worker(tagName string, partition map[string]string) *ObjectWorker {
+	key := state.workerKey(state.bucket, tagName, partition)
+	work := state.pinWorker(key, state.bucket, tagName, partition)
+	state.unpinWorkers([]string{key})
+	return work
+}
+
+// Test_workerLRU are the keys kept in order of use?
+func Test_workerLRU(t *testing.T) {
+	lru := newWorkerLRU()
+	if _, _, ok := lru.oldest(); ok {
+		t.Fatal("an empty lru has an oldest key")
+	}
+	begin := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	lru.touch("a", begin)
+	lru.touch("b", begin.Add(time.Second))
+	lru.touch("c", begin.Add(2*time.Second))
+	lru.touch("a", begin.Add(3*time.Second))
+
+	if key, used, _ := lru.oldest(); key != "b" || !used.Equal(begin.Add(time.Second)) {
+		t.Errorf("oldest %s at %s, wanted b", key, used)
+	}
+	lru.remove("b")
+	lru.remove("nope")
+	if key, _, _ := lru.oldest(); key != "c" || lru.len() != 2 {
+		t.Errorf("oldest %s of %d, wanted c of 2", key, lru.len())
+	}
+
+	lru.touch("d", begin.Add(4*time.Second))
+	var walked []string
+	lru.walk(func(key string, used time.Time) bool {
+		walked = append(walked, key)
+		lru.remove(key)
+		return key != "a"
+	})
+	if strings.Join(walked, ",") != "c,a" || lru.len() != 1 {
+		t.Errorf("walked %v, leaving %d, wanted c,a leaving d", walked, lru.len())
+	}
+}
+
+// newEvictionStateForTest an instance with a clock for test, evicting workers by workerIdleSeconds and maxWorkers
+func newEvictionStateForTest(workerIdleSeconds int, maxWorkers int) (*outputState, *storageClientForTest, *clockForTest) {
+	cli := &storageClientForTest{}
+	clk := newClockForTest()
+	state := newShutdownStateForTest("evicting", cli)
+	state.clock = clk
+	state.workerIdleSeconds = workerIdleSeconds
+	state.maxWorkers = maxWorkers
+	return state, cli, clk
+}
+
+// Test_worker_idle is a worker not used for WorkerIdleSeconds closed, committing its object, and forgotten?
+func Test_worker_idle(t *testing.T) {
+	state, cli, clk := newEvictionStateForTest(60, 0)
+	committed := metrics.objectsCommitted.WithLabelValues("evicting", "quiet-tag")
+	evicted := metrics.workersEvicted.WithLabelValues("evicting", "quiet-tag")
+	committedBefore, evictedBefore := testutil.ToFloat64(committed), testutil.ToFloat64(evicted)
+
+	state.worker("quiet-tag", nil).Put(cli, *bytes.NewBufferString("quiet\n"))
+	clk.Advance(30 * time.Second)
+	state.worker("busy-tag", nil).Put(cli, *bytes.NewBufferString("busy\n"))
+	if len(state.workers) != 2 {
+		t.Fatalf("%d workers before WorkerIdleSeconds", len(state.workers))
+	}
+
+	clk.Advance(30 * time.Second)
+	state.worker("busy-tag", nil)
+	if _, ok := state.workers["quiet-tag"]; ok || len(state.workers) != 1 {
+		t.Errorf("the idle worker was not evicted: %v", state.workers)
+	}
+	if got := testutil.ToFloat64(committed) - committedBefore; got != 1 {
+		t.Errorf("%v objects committed, wanted the idle worker's", got)
+	}
+	if got := testutil.ToFloat64(evicted) - evictedBefore; got != 1 {
+		t.Errorf("workers_evicted_total %v", got)
+	}
+}
+
+// Test_worker_maxWorkers is the least recently used worker closed to make room for another, beyond MaxWorkers?
+func Test_worker_maxWorkers(t *testing.T) {
+	state, _, clk := newEvictionStateForTest(0, 2)
+
+	first := state.worker("a", nil)
+	clk.Advance(time.Second)
+	state.worker("b", nil)
+	clk.Advance(time.Second)
+	if state.worker("a", nil) != first {
+		t.Fatal("a worker in use was replaced")
+	}
+	clk.Advance(time.Second)
+	state.worker("c", nil)
+
+	if len(state.workers) != 2 {
+		t.Fatalf("%d workers, wanted MaxWorkers 2: %v", len(state.workers), state.workers)
+	}
+	if _, ok := state.workers["b"]; ok {
+		t.Errorf("the least recently used worker was not evicted: %v", state.workers)
+	}
+}
+
+// Test_flbPluginFlushCtxGo_maxWorkers does a chunk with more partitions than MaxWorkers write every one, evicting
+// workers only after the chunk was written?
+func Test_flbPluginFlushCtxGo_maxWorkers(t *testing.T) {
+	state, cli, _ := newEvictionStateForTest(0, 2)
+	state.partitionKeys = []string{"service"}
+	state.objectNameTemplate = "{{ .InputTag }}/{{ .Partition.service }}"
+
+	chunk := chunkForTest(map[string]string{"service": "api"}, map[string]string{"service": "db"}, map[string]string{"service": "web"})
+	if rc := flbPluginFlushCtxGo(state, goBytesToCBytes(chunk), len(chunk), "my-tag"); rc != output.FLB_OK {
+		t.Fatalf("the flush returned %d, wanted FLB_OK", rc)
+	}
+	if len(state.workers) != 2 || len(state.pins) != 0 {
+		t.Errorf("%d workers and %d pinned after the flush, wanted MaxWorkers 2 and none", len(state.workers), len(state.pins))
+	}
+
+	for _, work := range state.workers {
+		work.Close()
+	}
+	for _, service := range []string{"api", "db", "web"} {
+		if wri := cli.objects["bucketymcbucketface.example.com/my-tag/"+service]; wri == nil || wri.buf.Len() == 0 {
+			t.Errorf("the %s partition was not written: %#v", service, wri)
+		}
+	}
+}
+
+// hasSeriesForTest is there a series of the metric family for the output and tag?
+func hasSeriesForTest(family, outputID, tag string) bool {
+	families, _ := metrics.registry.Gather()
+	for _, mf := range families {
+		if mf.GetName() != family {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["output_id"] == outputID && labels["tag"] == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Test_worker_evictedMetrics are the series of a tag deleted with its last worker, and kept while another worker
+// (of another partition) has the tag?
+func Test_worker_evictedMetrics(t *testing.T) {
+	state, cli, clk := newEvictionStateForTest(60, 0)
+	state.outputID = "evicting-metrics"
+	state.partitionKeys = []string{"p"}
+
+	state.worker("my-tag", map[string]string{"p": "a"}).Put(cli, *bytes.NewBufferString("a\n"))
+	clk.Advance(30 * time.Second)
+	state.worker("my-tag", map[string]string{"p": "b"}).Put(cli, *bytes.NewBufferString("b\n"))
+	clk.Advance(30 * time.Second)
+	state.worker("other-tag", nil)
+	if len(state.workers) != 2 {
+		t.Fatalf("%d workers, wanted partition a evicted", len(state.workers))
+	}
+	if !hasSeriesForTest("flb_output_gcs_open_workers", "evicting-metrics", "my-tag") {
+		t.Error("the series of my-tag were deleted while partition b has a worker")
+	}
+
+	// the series that aren't made with a worker
+	metrics.received("evicting-metrics", "my-tag", 1, 10)
+	metrics.uploadRetries.WithLabelValues("evicting-metrics", "my-tag").Inc()
+	metrics.flushRetries.WithLabelValues("evicting-metrics", "my-tag").Inc()
+	metrics.bucketFallbacks.WithLabelValues("evicting-metrics", "my-tag").Inc()
+	if !hasSeriesForTest("flb_output_gcs_workers_evicted_total", "evicting-metrics", "my-tag") {
+		t.Error("the eviction of partition a wasn't counted")
+	}
+
+	clk.Advance(30 * time.Second)
+	state.worker("other-tag", nil)
+	for _, family := range []string{
+		"flb_output_gcs_records_received_total",
+		"flb_output_gcs_received_bytes_total",
+		"flb_output_gcs_uncompressed_bytes_total",
+		"flb_output_gcs_written_bytes_total",
+		"flb_output_gcs_objects_committed_total",
+		"flb_output_gcs_commit_failures_total",
+		"flb_output_gcs_upload_retries_total",
+		"flb_output_gcs_flush_retries_total",
+		"flb_output_gcs_open_workers",
+		"flb_output_gcs_workers_evicted_total",
+		"flb_output_gcs_buffered_bytes",
+		"flb_output_gcs_bucket_fallbacks_total",
+	} {
+		if hasSeriesForTest(family, "evicting-metrics", "my-tag") {
+			t.Errorf("%s of my-tag is left after its last worker was evicted", family)
+		}
+	}
+	if !hasSeriesForTest("flb_output_gcs_open_workers", "evicting-metrics", "other-tag") {
+		t.Error("the series of other-tag were deleted")
+	}
+}